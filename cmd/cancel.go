@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/spf13/cobra"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+	"github.com/SKAhack/shipctl/lib/tracing"
+)
+
+type cancelCmd struct {
+	cluster          string
+	serviceName      string
+	backend          string
+	slackWebhookUrls []string
+	slackUsername    string
+	slackChannel     string
+	notifyOn         string
+	color            string
+	awsOpts          awsOptions
+	historyOpts      historyOptions
+	quiet            bool
+}
+
+func NewCancelCommand(out, errOut io.Writer) *cobra.Command {
+	f := &cancelCmd{}
+	cmd := &cobra.Command{
+		Use:   "cancel [options]",
+		Short: "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			slackWebhookUrls, err := resolveSlackWebhookURLs(f.slackWebhookUrls, &f.awsOpts)
+			if err != nil {
+				return err
+			}
+			l := log.NewLogger(f.cluster, f.serviceName, slackWebhookUrls, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			l.Quiet = f.quiet
+			l.SlackUsername = f.slackUsername
+			l.SlackChannel = f.slackChannel
+			notifyOn, err := log.ParseNotifyOn(f.notifyOn)
+			if err != nil {
+				return err
+			}
+			l.NotifyOn = notifyOn
+			l.Color, err = colorEnabled(f.color, errOut)
+			if err != nil {
+				return err
+			}
+			err = f.execute(cmd, args, l)
+			if err != nil {
+				msg := fmt.Sprintf("failed to cancel. cluster: %s, serviceName: %s\n", f.cluster, f.serviceName)
+				l.Status("danger", msg)
+				l.Slack("danger", msg)
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
+	cmd.Flags().StringArrayVar(&f.slackWebhookUrls, "slack-webhook-url", []string{}, "slack webhook URL with an optional severity filter (URL[#all|info|success|failure]). ssm://NAME reads the URL from the SSM parameter. $SLACK_WEBHOOK_URL by default")
+	cmd.Flags().StringVar(&f.slackUsername, "slack-username", "deploy-bot", "username of slack notifications")
+	cmd.Flags().StringVar(&f.slackChannel, "slack-channel", "", "channel of slack notifications. the default channel of the webhook by default")
+	cmd.Flags().StringVar(&f.notifyOn, "notify-on", "start,success,failure", "comma-separated events to notify to slack (start, success, failure)")
+	cmd.Flags().StringVar(&f.color, "color", "auto", "color success and failure messages (auto, always or never). auto colors them if stderr is a terminal")
+	f.awsOpts.addFlags(cmd.Flags())
+	f.historyOpts.addFlags(cmd.Flags())
+	cmd.Flags().BoolVarP(&f.quiet, "quiet", "q", false, "suppress periodic progress messages")
+
+	return cmd
+}
+
+func (f *cancelCmd) execute(_ *cobra.Command, args []string, l *log.Logger) (err error) {
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "cancel")
+	defer func() { tracing.End(span, err) }()
+
+	if f.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return errors.New("--service-name is required")
+	}
+
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+	f.cluster, f.serviceName = cluster, serviceName
+	span.SetAttributes(tracing.Service(f.cluster, f.serviceName)...)
+
+	region := f.awsOpts.resolveRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+	l.ConsoleURL = ecsConsoleURL(region, f.cluster, f.serviceName)
+
+	sess, err := newAWSSession(&f.awsOpts)
+	if err != nil {
+		return err
+	}
+
+	err = checkCredentials(ctx, sess, f.awsOpts.config(region), l)
+	if err != nil {
+		return err
+	}
+
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName, &f.awsOpts, &f.historyOpts)
+	if err != nil {
+		return err
+	}
+
+	states, err := historyManager.Pull()
+	if err != nil {
+		return err
+	}
+
+	// a deploy is in progress while its state is PENDING, or CANARY until deploy --promote
+	if len(states) == 0 {
+		return errors.New("no deploy is in progress. history is empty")
+	}
+	state := states[len(states)-1]
+	if state.Status != deployStatus_PENDING && state.Status != deployStatus_CANARY {
+		return errors.New(fmt.Sprintf("no deploy is in progress. revision %d is %s", state.Revision, state.Status))
+	}
+
+	// the service is reverted to the last revision deployed before the in-progress one
+	var target *deployState
+	for i := len(states) - 2; i >= 0; i-- {
+		if states[i].Status == deployStatus_DEPLOYED && states[i].Revision != state.Revision {
+			target = states[i]
+			break
+		}
+	}
+	if target == nil {
+		return errors.New(fmt.Sprintf("can not found a deployed revision before revision %d", state.Revision))
+	}
+
+	l.Debug(fmt.Sprintf("describe service %s\n", f.serviceName))
+	service, err := describeService(ctx, client, f.cluster, f.serviceName, region, l)
+	if err != nil {
+		return err
+	}
+
+	if service.DeploymentController != nil && aws.StringValue(service.DeploymentController.Type) == ecs.DeploymentControllerTypeCodeDeploy {
+		return errors.New("cancel is not supported for the CODE_DEPLOY deployment controller. stop the deployment in CodeDeploy")
+	}
+
+	taskDefArn, err := libecs.SpecifyRevision(target.Revision, *service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+
+	l.Debug(fmt.Sprintf("describe task definition %s\n", taskDefArn))
+	taskDef, err := libecs.DescribeTaskDefinition(ctx, client, taskDefArn)
+	if err != nil {
+		return err
+	}
+
+	if aws.StringValue(taskDef.Status) == ecs.TaskDefinitionStatusInactive {
+		return errors.New(fmt.Sprintf("revision %d is deregistered (INACTIVE). use rollback --to-revision instead", target.Revision))
+	}
+
+	var msg string
+	msg = fmt.Sprintf("cancel: revision %d -> %d\n", state.Revision, target.Revision)
+	l.Log(msg)
+	l.Slack("normal", msg)
+
+	err = cancelDeploy(ctx, client, historyManager, f.cluster, service, taskDef, state, target, l)
+	if err != nil {
+		return err
+	}
+
+	msg = fmt.Sprintf("successfully cancelled\n")
+	l.Status("good", msg)
+	l.Slack("good", msg)
+
+	return nil
+}
+
+// cancelDeploy reverts the service to the target and marks the in-progress state as CANCELLED.
+// the state is kept as it is if the service fails to be reverted, so that the cancel can be retried
+func cancelDeploy(ctx context.Context, client libecs.ECSAPI, historyManager historyManager, cluster string, service *ecs.Service, taskDef *ecs.TaskDefinition, state, target *deployState, l *log.Logger) error {
+	// a canary is reverted to the desired count before the canary
+	if state.DesiredCount > 0 {
+		v := *service // shallow copy
+		v.DesiredCount = aws.Int64(state.DesiredCount)
+		service = &v
+	}
+
+	err := rollbackService(
+		ctx, client, historyManager, cluster, service, taskDef,
+		fmt.Sprintf("cancel: %d -> %d", state.Revision, target.Revision),
+		l,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = historyManager.UpdateState(state.Revision, deployStatus_CANCELLED)
+	if err != nil {
+		return fmt.Errorf("the service is reverted, but failed to mark revision %d as CANCELLED: %w", state.Revision, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+)
+
+func TestCancelDeployHistory(t *testing.T) {
+	defer func(v time.Duration) { libecs.WaitInterval = v }(libecs.WaitInterval)
+	libecs.WaitInterval = time.Millisecond
+
+	tests := []struct {
+		name      string
+		updateErr error
+		// rolloutState is the rollout state of the primary deployment after the update
+		rolloutState string
+		// wantCancelled means revision 10 is marked as CANCELLED
+		wantCancelled bool
+	}{
+		{name: "success", rolloutState: ecs.DeploymentRolloutStateCompleted, wantCancelled: true},
+		{name: "update fails", updateErr: errors.New("update failed")},
+		{name: "deployment fails", rolloutState: ecs.DeploymentRolloutStateFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			historyManager := NewSSMHistoryManagerWithClient(newFakeSSM(), "foo", "bar")
+			err := historyManager.PushState(9, deployStatus_DEPLOYED, "deploy: 8 -> 9")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = historyManager.PushState(10, deployStatus_PENDING, "deploy: 9 -> 10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			states, err := historyManager.Pull()
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, state := states[0], states[1]
+
+			service := &ecs.Service{
+				ClusterArn:     aws.String("arn:aws:ecs:ap-northeast-1:123456789012:cluster/foo"),
+				ServiceName:    aws.String("bar"),
+				TaskDefinition: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/bar:10"),
+				DesiredCount:   aws.Int64(2),
+				RunningCount:   aws.Int64(2),
+			}
+
+			var updatedTo string
+			client := &fakeECS{
+				updateService: func(in *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+					if tt.updateErr != nil {
+						return nil, tt.updateErr
+					}
+					updatedTo = aws.StringValue(in.TaskDefinition)
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+				describeServices: func(in *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+					s := *service // shallow copy
+					s.TaskDefinition = aws.String(updatedTo)
+					s.Deployments = []*ecs.Deployment{{
+						Id:             aws.String("ecs-svc/1"),
+						Status:         aws.String("PRIMARY"),
+						TaskDefinition: aws.String(updatedTo),
+						RolloutState:   aws.String(tt.rolloutState),
+					}}
+					return &ecs.DescribeServicesOutput{Services: []*ecs.Service{&s}}, nil
+				},
+			}
+
+			taskDef := &ecs.TaskDefinition{
+				TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/bar:9"),
+				Revision:          aws.Int64(9),
+			}
+			err = cancelDeploy(context.Background(), client, historyManager, "foo", service, taskDef, state, target, testLogger())
+
+			states, perr := historyManager.Pull()
+			if perr != nil {
+				t.Fatal(perr)
+			}
+
+			if !tt.wantCancelled {
+				if _, ok := err.(*rollbackFailure); !ok {
+					t.Errorf("error = %v, want a rollbackFailure", err)
+				}
+				// the deploy is still in progress, so that the cancel can be retried
+				if len(states) != 2 || states[1].Revision != 10 || states[1].Status != deployStatus_PENDING {
+					t.Errorf("history is changed by a failed cancel: %+v", states[len(states)-1])
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(states) != 3 || states[1].Status != deployStatus_CANCELLED {
+				t.Errorf("revision 10 is not cancelled: %+v", states[1])
+			}
+			latest := states[len(states)-1]
+			if latest.Revision != 9 || latest.Status != deployStatus_DEPLOYED || latest.Cause != "cancel: 10 -> 9" {
+				t.Errorf("history does not match the service running revision 9: %+v", latest)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const configFileName = ".shipctl.yaml"
+
+// envFlags are flags which fall back to the environment variables
+var envFlags = map[string]string{
+	"cluster":      "SHIPCTL_CLUSTER",
+	"service-name": "SHIPCTL_SERVICE_NAME",
+}
+
+// LoadEnv sets flags of the command from the environment variables of envFlags.
+// flags specified in the command line override the environment variables
+func LoadEnv(cmd *cobra.Command) error {
+	for key, env := range envFlags {
+		flag := cmd.Flags().Lookup(key)
+		if flag == nil || flag.Changed {
+			continue
+		}
+
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+
+		err := cmd.Flags().Set(key, v)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid %s: %s", env, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// findConfigFile returns the path of the config file in the current directory or the home directory.
+// it returns an empty string if the config file is not found
+func findConfigFile() string {
+	dirs := []string{"."}
+	if home := os.Getenv("HOME"); home != "" {
+		dirs = append(dirs, home)
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// LoadConfigFile sets flags of the command from the config file.
+// keys of the config file are flag names, e.g. cluster or slack-webhook-url.
+// flags specified in the command line override the values of the config file,
+// and keys which the command does not have are ignored.
+func LoadConfigFile(cmd *cobra.Command) error {
+	path := findConfigFile()
+	if path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	config := map[string]interface{}{}
+	err = yaml.Unmarshal(b, &config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to parse %s: %s", path, err.Error()))
+	}
+
+	for key, value := range config {
+		flag := cmd.Flags().Lookup(key)
+		if flag == nil || flag.Changed {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+
+		for _, v := range values {
+			err = cmd.Flags().Set(key, fmt.Sprint(v))
+			if err != nil {
+				return errors.New(fmt.Sprintf("invalid %s in %s: %s", key, path, err.Error()))
+			}
+		}
+	}
+
+	return nil
+}
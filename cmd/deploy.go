@@ -1,38 +1,109 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ssm"
 
 	"github.com/docker/distribution/reference"
 	"github.com/oklog/ulid"
 	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
 
+	"github.com/SKAhack/shipctl/lib/awsutil"
+	libcodedeploy "github.com/SKAhack/shipctl/lib/codedeploy"
 	libecs "github.com/SKAhack/shipctl/lib/ecs"
 	log "github.com/SKAhack/shipctl/lib/logger"
+	"github.com/SKAhack/shipctl/lib/tracing"
 )
 
 var ECRRegex *regexp.Regexp = func() *regexp.Regexp {
-	regex, _ := regexp.Compile(`^[0-9]+\.dkr\.ecr\.(us|ca|eu|ap|sa)-(east|west|central|northeast|southeast|south)-[12]\.amazonaws\.com$`)
+	regex, _ := regexp.Compile(`^[0-9]+\.dkr\.ecr\.([a-z]{2}(?:-[a-z]+)+-\d)\.amazonaws\.com$`)
 	return regex
 }()
 
 type deployCmd struct {
-	cluster         string
-	serviceName     string
-	revision        int
-	images          imageOptions
-	backend         string
-	slackWebhookUrl string
+	cluster                   string
+	serviceName               string
+	revision                  int
+	images                    imageOptions
+	imagesFile                string
+	capacityProviders         capacityProviderOptions
+	propagateTags             string
+	enableManagedTags         bool
+	tags                      keyValueOptions
+	containerCPU              keyValueOptions
+	containerMemory           keyValueOptions
+	createIfMissing           bool
+	desiredCount              int64
+	launchType                string
+	subnets                   []string
+	securityGroups            []string
+	assignPublicIP            string
+	allowZeroDesired          bool
+	deployID                  string
+	outputFormat              string
+	clusterList               clusterTargetOptions
+	batchFile                 string
+	concurrency               int
+	platformVersion           string
+	detach                    bool
+	waitForSteadyState        bool
+	autoRollback              bool
+	cleanupOnFailure          bool
+	promoteTag                string
+	requireImmutableTags      bool
+	canaryCount               int64
+	promote                   bool
+	registerOnly              bool
+	updateOnly                bool
+	codedeployApplication     string
+	codedeployDeploymentGroup string
+	forceNewDeployment        bool
+	preDeploySSM              keyValueOptions
+	postDeploySSM             keyValueOptions
+	maxPercent                int64
+	minHealthyPercent         int64
+	summaryFile               string
+	output                    string
+	taskTemplate              string
+	pruneOldRevisions         int
+	family                    string
+	updateService             bool
+	valuesFile                string
+	backend                   string
+	slackWebhookUrls          []string
+	slackUsername             string
+	slackChannel              string
+	notifyOn                  string
+	color                     string
+	awsOpts                   awsOptions
+	historyOpts               historyOptions
+	quiet                     bool
+	pushgatewayURL            string
+
+	result *deployResult
+	// registeredTaskDefArn is the task definition registered by this deploy, for --cleanup-on-failure
+	registeredTaskDefArn string
 }
 
 func NewDeployCommand(out, errOut io.Writer) *cobra.Command {
@@ -41,28 +112,321 @@ func NewDeployCommand(out, errOut io.Writer) *cobra.Command {
 		Use:   "deploy [options]",
 		Short: "",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			l := log.NewLogger(f.cluster, f.serviceName, f.slackWebhookUrl, out)
-			err := f.execute(cmd, args, l)
+			// resolved once, since clusters of --cluster-list may be in other regions
+			slackWebhookUrls, err := resolveSlackWebhookURLs(f.slackWebhookUrls, &f.awsOpts)
 			if err != nil {
-				msg := fmt.Sprintf("failed to deploy. cluster: %s, serviceName: %s\n", f.cluster, f.serviceName)
-				l.Log(msg)
-				l.Slack("danger", msg)
 				return err
 			}
-			return nil
+			f.slackWebhookUrls = slackWebhookUrls
+			if f.batchFile != "" {
+				return f.runBatchFile(cmd, args, out, errOut)
+			}
+			if len(f.clusterList.Value) > 0 {
+				return f.runClusterList(cmd, args, out, errOut)
+			}
+			return f.run(cmd, args, out, errOut, "")
 		},
 	}
 	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().IntVar(&f.concurrency, "concurrency", 3, "max number of clusters of --cluster-list or services of --batch-file to deploy to in parallel")
+	cmd.Flags().StringVar(&f.batchFile, "batch-file", "", "path to a YAML file listing services to deploy concurrently with their clusters, regions and images")
+	cmd.Flags().Var(&f.clusterList, "cluster-list", "cluster to deploy to concurrently (CLUSTER[@REGION]). the region of --region by default. can be specified multiple times")
 	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
 	cmd.Flags().IntVar(&f.revision, "revision", 0, "revision of ECS task definition")
 	cmd.Flags().Var(&f.images, "image", "base image of ECR image")
+	cmd.Flags().StringVar(&f.imagesFile, "images-file", "", "path to a YAML or JSON file mapping repository names to tags. --image takes precedence")
+	cmd.Flags().Var(&f.containerCPU, "container-cpu", "CPU units of the container in the registered task definition (NAME=UNITS). can be specified multiple times")
+	cmd.Flags().Var(&f.containerMemory, "container-memory", "memory in MiB of the container in the registered task definition (NAME=MIB). can be specified multiple times")
+	cmd.Flags().Var(&f.capacityProviders, "capacity-provider", "capacity provider strategy item (NAME[:WEIGHT[:BASE]])")
+	cmd.Flags().Int64Var(&f.canaryCount, "canary-count", 0, "run the new revision with the desired count N as a canary until deploy --promote")
+	cmd.Flags().BoolVar(&f.promote, "promote", false, "scale the canary back to the original desired count")
+	cmd.Flags().BoolVar(&f.registerOnly, "register-only", false, "register the task definition without updating the service")
+	cmd.Flags().BoolVar(&f.updateOnly, "update-only", false, "update the service to the registered revision of --revision without registering")
+	cmd.Flags().BoolVar(&f.requireImmutableTags, "require-immutable-tags", false, "fail unless the ECR repositories of --image have tag immutability enabled")
+	cmd.Flags().StringVar(&f.promoteTag, "promote-tag", "", "floating tag to move to the deployed images in ECR after a successful deploy")
+	cmd.Flags().StringVar(&f.propagateTags, "propagate-tags", "", "propagate tags to tasks from SERVICE, TASK_DEFINITION or NONE")
+	cmd.Flags().BoolVar(&f.enableManagedTags, "enable-managed-tags", false, "enable Amazon ECS managed tags for the tasks")
+	cmd.Flags().BoolVar(&f.forceNewDeployment, "force-new-deployment", false, "force a new deployment. --image can be omitted to restart tasks with the current task definition")
+	cmd.Flags().BoolVar(&f.createIfMissing, "create-if-missing", false, "create the service if it does not exist. requires --task-template or --family")
+	cmd.Flags().Int64Var(&f.desiredCount, "desired-count", 1, "desired count of the service created by --create-if-missing")
+	cmd.Flags().StringVar(&f.launchType, "launch-type", "", "launch type of the service created by --create-if-missing (EC2, FARGATE or EXTERNAL)")
+	cmd.Flags().StringArrayVar(&f.subnets, "subnet", []string{}, "subnet of the service created by --create-if-missing. can be specified multiple times")
+	cmd.Flags().StringArrayVar(&f.securityGroups, "security-group", []string{}, "security group of the service created by --create-if-missing. can be specified multiple times")
+	cmd.Flags().StringVar(&f.assignPublicIP, "assign-public-ip", "", "assign a public IP to the tasks of the service created by --create-if-missing (ENABLED or DISABLED)")
+	cmd.Flags().StringVar(&f.deployID, "deploy-id", "", "ID to correlate the deploy with other systems, e.g. a release ID of the pipeline. the unique tag of images by default")
+	cmd.Flags().BoolVar(&f.allowZeroDesired, "allow-zero-desired", false, "deploy even if the desired count of the service is 0")
+	cmd.Flags().Var(&f.tags, "tag", "tag of the registered task definition (KEY=VALUE). merged with the tags of the current task definition")
+	cmd.Flags().Var(&f.preDeploySSM, "pre-deploy-ssm", "SSM parameter to put before updating the service (NAME=VALUE)")
+	cmd.Flags().Var(&f.postDeploySSM, "post-deploy-ssm", "SSM parameter to put after the service is successfully updated (NAME=VALUE)")
+	cmd.Flags().BoolVar(&f.autoRollback, "auto-rollback", false, "rollback to the previous revision if the service fails to be updated")
+	cmd.Flags().BoolVar(&f.cleanupOnFailure, "cleanup-on-failure", false, "deregister the task definition registered by a failed deploy unless it is deployed or used by the service")
+	cmd.Flags().BoolVar(&f.detach, "detach", false, "exit right after updating the service without waiting for completion")
+	cmd.Flags().BoolVar(&f.waitForSteadyState, "wait-for-steady-state", true, "wait until the previous deployment is drained and the rollout is completed. false only waits for the running count to reach the desired count")
+	cmd.Flags().StringVar(&f.taskTemplate, "task-template", "", "path to a Go template of task definition JSON to register instead of the current task definition")
+	cmd.Flags().StringVar(&f.valuesFile, "values", "", "path to a JSON file of values for --task-template")
+	cmd.Flags().StringVar(&f.codedeployApplication, "codedeploy-application", "", "CodeDeploy application of a service with the CODE_DEPLOY deployment controller (default \"AppECS-CLUSTER-SERVICE\")")
+	cmd.Flags().StringVar(&f.codedeployDeploymentGroup, "codedeploy-deployment-group", "", "CodeDeploy deployment group of a service with the CODE_DEPLOY deployment controller (default \"DgpECS-CLUSTER-SERVICE\")")
+	cmd.Flags().StringVar(&f.family, "family", "", "family to register the new task definition into")
+	cmd.Flags().BoolVar(&f.updateService, "update-service", false, "update the service even if --family differs from the current family")
+	cmd.Flags().IntVar(&f.pruneOldRevisions, "prune-old-revisions", 0, "deregister task definitions older than the newest N revisions in the family after a successful deploy")
+	cmd.Flags().StringVar(&f.platformVersion, "platform-version", "", "Fargate platform version of the service, e.g. 1.4.0")
+	cmd.Flags().StringVar(&f.outputFormat, "output-format", "text", "format of the result. json prints a JSON summary of the deploy as the last line of stdout (text or json)")
+	cmd.Flags().StringVar(&f.output, "output", "", "path to write the registered revision, task definition ARN, unique ID and deploy ID in JSON. \"-\" means stdout")
+	cmd.Flags().Int64Var(&f.maxPercent, "max-percent", -1, "maximum percent of the deployment configuration. -1 means the service's")
+	cmd.Flags().Int64Var(&f.minHealthyPercent, "min-healthy-percent", -1, "minimum healthy percent of the deployment configuration. -1 means the service's")
+	cmd.Flags().StringVar(&f.summaryFile, "summary-file", "", "path to write a markdown report of the deploy")
 	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
-	cmd.Flags().StringVar(&f.slackWebhookUrl, "slack-webhook-url", "", "slack webhook URL")
+	cmd.Flags().StringArrayVar(&f.slackWebhookUrls, "slack-webhook-url", []string{}, "slack webhook URL with an optional severity filter (URL[#all|info|success|failure]). ssm://NAME reads the URL from the SSM parameter. $SLACK_WEBHOOK_URL by default")
+	cmd.Flags().StringVar(&f.slackUsername, "slack-username", "deploy-bot", "username of slack notifications")
+	cmd.Flags().StringVar(&f.slackChannel, "slack-channel", "", "channel of slack notifications. the default channel of the webhook by default")
+	cmd.Flags().StringVar(&f.notifyOn, "notify-on", "start,success,failure", "comma-separated events to notify to slack (start, success, failure)")
+	cmd.Flags().StringVar(&f.color, "color", "auto", "color success and failure messages (auto, always or never). auto colors them if stderr is a terminal")
+	f.awsOpts.addFlags(cmd.Flags())
+	f.historyOpts.addFlags(cmd.Flags())
+	cmd.Flags().BoolVarP(&f.quiet, "quiet", "q", false, "suppress periodic progress messages")
+	cmd.Flags().StringVar(&f.pushgatewayURL, "pushgateway-url", "", "URL of a Prometheus Pushgateway to push deploy_duration_seconds and deploy_result to at the end of the deploy")
 
 	return cmd
 }
 
-func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+// run deploys to the cluster and reports the result. prefix is prepended to logs of the cluster
+func (f *deployCmd) run(cmd *cobra.Command, args []string, out, errOut io.Writer, prefix string) error {
+	l := log.NewLogger(f.cluster, f.serviceName, f.slackWebhookUrls, out, errOut)
+	l.Verbose = f.awsOpts.verbose
+	l.Quiet = f.quiet
+	l.Prefix = prefix
+	l.SlackUsername = f.slackUsername
+	l.SlackChannel = f.slackChannel
+	notifyOn, err := log.ParseNotifyOn(f.notifyOn)
+	if err != nil {
+		return err
+	}
+	l.NotifyOn = notifyOn
+	l.Color, err = colorEnabled(f.color, errOut)
+	if err != nil {
+		return err
+	}
+	f.result = &deployResult{
+		Cluster:     f.cluster,
+		ServiceName: f.serviceName,
+		StartedAt:   time.Now(),
+	}
+	if f.outputFormat != "text" && f.outputFormat != "json" {
+		return errors.New(fmt.Sprintf("invalid --output-format %s. it must be text or json", f.outputFormat))
+	}
+	err = f.execute(cmd, args, l)
+	f.result.FinishedAt = time.Now()
+	f.result.Err = err
+	pushDeployMetrics(f.pushgatewayURL, "deploy", f.cluster, f.serviceName, f.result.ToRevision, f.result.StartedAt, err, l)
+	if f.summaryFile != "" {
+		if werr := f.result.WriteMarkdown(f.summaryFile); werr != nil {
+			l.Log(fmt.Sprintf("failed to write summary file: %s\n", werr.Error()))
+		}
+	}
+	if err != nil {
+		msg := f.result.FailureMessage(f.images.Value)
+		l.Status("danger", msg)
+		l.Slack("danger", msg)
+		if f.cleanupOnFailure && f.registeredTaskDefArn != "" {
+			if cerr := f.cleanupTaskDefinition(f.registeredTaskDefArn, l); cerr != nil {
+				l.Log(fmt.Sprintf("warning: failed to deregister %s: %s\n", f.registeredTaskDefArn, cerr.Error()))
+			}
+		}
+	} else if f.output != "" {
+		err = f.result.WriteOutput(f.output, out)
+	}
+	// the summary is the last line of stdout for machine consumption
+	if f.outputFormat == "json" {
+		if werr := f.result.WriteJSON(f.images.Value, out); werr != nil {
+			l.Log(fmt.Sprintf("failed to write JSON summary: %s\n", werr.Error()))
+		}
+	}
+	return err
+}
+
+// runClusterList deploys to the clusters of --cluster-list concurrently.
+// each cluster has its own history, since SSM parameters are per region
+func (f *deployCmd) runClusterList(cmd *cobra.Command, args []string, out, errOut io.Writer) error {
+	if f.cluster != "" {
+		return errors.New("--cluster-list can not be used with --cluster")
+	}
+
+	if f.output != "" || f.summaryFile != "" {
+		return errors.New("--cluster-list can not be used with --output nor --summary-file")
+	}
+
+	if f.concurrency < 1 {
+		return errors.New("--concurrency must be positive")
+	}
+
+	// the images file is loaded once, since the clusters share the images
+	if f.imagesFile != "" {
+		err := f.images.LoadFile(f.imagesFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var runs []*deployCmd
+	var labels []string
+	for _, v := range f.clusterList.Value {
+		g := *f // shallow copy
+		g.cluster = v.Cluster
+		if v.Region != "" {
+			g.awsOpts.region = v.Region
+		}
+		g.imagesFile = ""
+		runs = append(runs, &g)
+		labels = append(labels, v.String())
+	}
+
+	return f.runConcurrently(cmd, args, out, errOut, runs, labels, "clusters")
+}
+
+// batchEntry is a service to deploy in --batch-file
+type batchEntry struct {
+	Cluster string `yaml:"cluster"`
+	// Region is the region of the cluster. the region of --region by default
+	Region  string            `yaml:"region"`
+	Service string            `yaml:"service"`
+	Images  map[string]string `yaml:"images"`
+}
+
+func (f *deployCmd) runBatchFile(cmd *cobra.Command, args []string, out, errOut io.Writer) error {
+	if f.cluster != "" || f.serviceName != "" || len(f.clusterList.Value) > 0 {
+		return errors.New("--batch-file can not be used with --cluster, --service-name nor --cluster-list")
+	}
+
+	if f.output != "" || f.summaryFile != "" {
+		return errors.New("--batch-file can not be used with --output nor --summary-file")
+	}
+
+	if f.concurrency < 1 {
+		return errors.New("--concurrency must be positive")
+	}
+
+	b, err := ioutil.ReadFile(f.batchFile)
+	if err != nil {
+		return err
+	}
+
+	var entries []*batchEntry
+	err = yaml.Unmarshal(b, &entries)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to parse %s: %s", f.batchFile, err.Error()))
+	}
+	if len(entries) == 0 {
+		return errors.New(fmt.Sprintf("no service is found in %s", f.batchFile))
+	}
+
+	// --image and --images-file are shared by the entries, and images of an entry take precedence
+	if f.imagesFile != "" {
+		err := f.images.LoadFile(f.imagesFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var runs []*deployCmd
+	var labels []string
+	for i, v := range entries {
+		if v.Cluster == "" || v.Service == "" {
+			return errors.New(fmt.Sprintf("cluster and service are required for entry %d in %s", i+1, f.batchFile))
+		}
+
+		g := *f // shallow copy
+		g.cluster = v.Cluster
+		g.serviceName = v.Service
+		if v.Region != "" {
+			g.awsOpts.region = v.Region
+		}
+		g.imagesFile = ""
+		g.images = imageOptions{}
+
+		var repoNames []string
+		for k := range v.Images {
+			repoNames = append(repoNames, k)
+		}
+		sort.Strings(repoNames)
+		for _, repoName := range repoNames {
+			err := g.images.Set(fmt.Sprintf("%s:%s", repoName, v.Images[repoName]))
+			if err != nil {
+				return errors.New(fmt.Sprintf("invalid image %s of entry %d in %s: %s", repoName, i+1, f.batchFile, err.Error()))
+			}
+		}
+		for _, w := range f.images.Value {
+			if g.images.Get(w.RepositoryName) == nil {
+				g.images.Value = append(g.images.Value, w)
+			}
+		}
+
+		label := fmt.Sprintf("%s/%s", v.Cluster, v.Service)
+		if v.Region != "" {
+			label = fmt.Sprintf("%s@%s/%s", v.Cluster, v.Region, v.Service)
+		}
+		runs = append(runs, &g)
+		labels = append(labels, label)
+	}
+
+	return f.runConcurrently(cmd, args, out, errOut, runs, labels, "services")
+}
+
+// runConcurrently deploys runs up to --concurrency at once, and reports the results of labels at the end
+func (f *deployCmd) runConcurrently(cmd *cobra.Command, args []string, out, errOut io.Writer, runs []*deployCmd, labels []string, unit string) error {
+	// rollouts are limited by --concurrency to avoid throttling of the AWS API
+	errs := make([]error, len(runs))
+	sem := make(chan struct{}, f.concurrency)
+	var wg sync.WaitGroup
+	for i, g := range runs {
+		wg.Add(1)
+		go func(i int, g *deployCmd) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = g.run(cmd, args, out, errOut, fmt.Sprintf("[%s] ", labels[i]))
+		}(i, g)
+	}
+	wg.Wait()
+
+	failed := 0
+	exitCode := ExitCodeError
+	fmt.Fprintf(errOut, "results:\n")
+	w := tabwriter.NewWriter(errOut, 0, 4, 2, ' ', 0)
+	for i, label := range labels {
+		if errs[i] != nil {
+			failed++
+			fmt.Fprintf(w, "  %s\tfailure\t%s\n", label, strings.Replace(errs[i].Error(), "\n", " ", -1))
+			// a failed rollback is reported over a failed deployment
+			if code := ExitCodeOf(errs[i]); code == ExitCodeRollbackFailure || (code == ExitCodeDeployFailure && exitCode != ExitCodeRollbackFailure) {
+				exitCode = code
+			}
+		} else {
+			fmt.Fprintf(w, "  %s\tsuccess\t\n", label)
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		err := errors.New(fmt.Sprintf("failed to deploy to %d of %d %s", failed, len(runs), unit))
+		switch exitCode {
+		case ExitCodeRollbackFailure:
+			return &rollbackFailure{err: err}
+		case ExitCodeDeployFailure:
+			return &deployFailure{err: err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) (err error) {
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "deploy")
+	defer func() { tracing.End(span, err) }()
+
 	if f.cluster == "" {
 		return errors.New("--cluster is required")
 	}
@@ -71,119 +435,792 @@ func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) erro
 		return errors.New("--service-name is required")
 	}
 
-	if len(f.images.Value) == 0 {
-		return errors.New("--image is required")
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
 	}
+	f.cluster, f.serviceName = cluster, serviceName
+	span.SetAttributes(tracing.Service(f.cluster, f.serviceName)...)
+	f.result.Cluster, f.result.ServiceName = cluster, serviceName
 
-	region := getAWSRegion()
-	if region == "" {
-		return errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
+	if f.imagesFile != "" {
+		err := f.images.LoadFile(f.imagesFile)
+		if err != nil {
+			return err
+		}
 	}
 
-	sess, err := session.NewSession()
+	err = f.validate()
 	if err != nil {
 		return err
 	}
+	hasResources := len(f.containerCPU.Value) > 0 || len(f.containerMemory.Value) > 0
 
-	client := ecs.New(sess, &aws.Config{
-		Region: aws.String(region),
-	})
+	var uniqueID string
+	{
+		entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+		uniqueID = ulid.MustNew(ulid.Now(), entropy).String()
+	}
 
-	ecrClient := ecr.New(sess, &aws.Config{
-		Region: aws.String(region),
-	})
+	// the unique ID is the tag of images in ECR
+	l.Log(fmt.Sprintf("unique ID: %s\n", uniqueID))
+	f.result.UniqueID = uniqueID
+
+	// the unique ID of images is used to correlate the deploy if --deploy-id is omitted
+	deployID := f.deployID
+	if deployID == "" {
+		deployID = uniqueID
+	}
+	l.DeployID = deployID
+	f.result.DeployID = deployID
+	f.historyOpts.deployID = deployID
 
-	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName)
+	region := f.awsOpts.resolveRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+	l.ConsoleURL = ecsConsoleURL(region, f.cluster, f.serviceName)
+
+	sess, err := newAWSSession(&f.awsOpts)
 	if err != nil {
 		return err
 	}
 
-	service, err := libecs.DescribeService(client, f.cluster, f.serviceName)
+	err = checkCredentials(ctx, sess, f.awsOpts.config(region), l)
 	if err != nil {
 		return err
 	}
 
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	ecrClients := newECRClients(sess, &f.awsOpts, region)
+
+	ssmClient := ssm.New(sess, f.awsOpts.config(region))
+
+	codedeployClient := codedeploy.New(sess, f.awsOpts.config(region))
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName, &f.awsOpts, &f.historyOpts)
+	if err != nil {
+		return err
+	}
+
+	l.Debug(fmt.Sprintf("describe service %s\n", f.serviceName))
+	_, describeSpan := tracing.Start(ctx, "describe", tracing.Service(f.cluster, f.serviceName)...)
+	service, err := libecs.DescribeService(ctx, client, f.cluster, f.serviceName)
+	tracing.End(describeSpan, err)
+	if err == libecs.ErrServiceNotFound && f.createIfMissing {
+		return f.createService(ctx, client, ecrClients, historyManager, uniqueID, l)
+	}
+	if err != nil {
+		return serviceNotFoundError(ctx, client, f.cluster, f.serviceName, region, err, l)
+	}
+
 	if len(service.Deployments) > 1 {
 		return errors.New(fmt.Sprintf("%s is currently deploying", f.serviceName))
 	}
 
-	var uniqueID string
-	{
-		entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
-		uniqueID = ulid.MustNew(ulid.Now(), entropy).String()
+	// blue/green deployments of CodeDeploy are created instead of updating the service
+	isCodeDeploy := service.DeploymentController != nil && aws.StringValue(service.DeploymentController.Type) == ecs.DeploymentControllerTypeCodeDeploy
+	if isCodeDeploy {
+		if f.detach {
+			return errors.New("--detach is not supported for the CODE_DEPLOY deployment controller")
+		}
+		if f.autoRollback {
+			return errors.New("--auto-rollback is not supported for the CODE_DEPLOY deployment controller. use the rollback configuration of the deployment group")
+		}
+		if f.canaryCount > 0 || f.promote {
+			return errors.New("--canary-count is not supported for the CODE_DEPLOY deployment controller")
+		}
+	}
+
+	if f.platformVersion != "" && aws.StringValue(service.LaunchType) == ecs.LaunchTypeEc2 {
+		return errors.New(fmt.Sprintf("--platform-version is not supported on EC2. %s runs on EC2", f.serviceName))
+	}
+
+	// a service scaled to zero becomes stable immediately, so the deploy would succeed without running any task
+	if aws.Int64Value(service.DesiredCount) == 0 && !f.allowZeroDesired && !f.registerOnly {
+		return errors.New(fmt.Sprintf("the desired count of %s is 0. pass --allow-zero-desired to deploy it anyway", f.serviceName))
+	}
+
+	states, err := historyManager.Pull()
+	if err != nil {
+		return err
+	}
+	var canary *deployState
+	if len(states) > 0 && states[len(states)-1].Status == deployStatus_CANARY {
+		canary = states[len(states)-1]
+	}
+
+	if f.promote {
+		if canary == nil {
+			return errors.New("no canary is found in history")
+		}
+		return f.promoteCanary(ctx, client, historyManager, service, canary, l)
+	}
+
+	if canary != nil {
+		return errors.New(fmt.Sprintf("revision %d is running as a canary. run deploy --promote first", canary.Revision))
+	}
+
+	if f.canaryCount > 0 && f.canaryCount >= *service.DesiredCount {
+		return errors.New(fmt.Sprintf("--canary-count must be less than the desired count %d", *service.DesiredCount))
 	}
 
 	var taskDef *ecs.TaskDefinition
 	var registerdTaskDef *ecs.TaskDefinition
-	{
+	var digests map[string]string
+	if f.updateOnly {
+		l.Debug(fmt.Sprintf("describe task definition %s\n", *service.TaskDefinition))
+		taskDef, err = libecs.DescribeTaskDefinition(ctx, client, *service.TaskDefinition)
+		if err != nil {
+			return err
+		}
+		f.result.FromRevision = *taskDef.Revision
+
+		taskDefArn, err := libecs.SpecifyRevision(f.revision, *service.TaskDefinition)
+		if err != nil {
+			return err
+		}
+
+		l.Debug(fmt.Sprintf("describe task definition %s\n", taskDefArn))
+		registerdTaskDef, err = libecs.DescribeTaskDefinition(ctx, client, taskDefArn)
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(registerdTaskDef.Status) == ecs.TaskDefinitionStatusInactive {
+			return errors.New(fmt.Sprintf("revision %d is deregistered (INACTIVE)", f.revision))
+		}
+		f.result.ToRevision = *registerdTaskDef.Revision
+		f.result.TaskDefArn = *registerdTaskDef.TaskDefinitionArn
+		f.result.Images = newImageChanges(taskDef, registerdTaskDef)
+	} else {
 		taskDefArn := *service.TaskDefinition
 		taskDefArn, err = libecs.SpecifyRevision(f.revision, taskDefArn)
 		if err != nil {
 			return err
 		}
 
-		taskDef, err = libecs.DescribeTaskDefinition(client, taskDefArn)
-		if err != nil {
-			return err
+		l.Debug(fmt.Sprintf("describe task definition %s\n", taskDefArn))
+		taskDef, err = libecs.DescribeTaskDefinition(ctx, client, taskDefArn)
+		if err != nil {
+			return err
+		}
+		f.result.FromRevision = *taskDef.Revision
+
+		baseTaskDef := taskDef
+		if f.taskTemplate != "" {
+			baseTaskDef, err = renderTaskDefinition(f.taskTemplate, f.valuesFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(f.images.Value) == 0 && f.taskTemplate == "" && f.family == "" && !hasResources {
+			// reuse the current task definition
+			registerdTaskDef = taskDef
+		} else {
+			newTaskDef := baseTaskDef
+			if len(f.images.Value) > 0 {
+				// images are checked before anything is mutated, so that no state points to a missing image
+				if f.requireImmutableTags {
+					err = f.checkImmutableTags(ctx, ecrClients, baseTaskDef, l)
+					if err != nil {
+						return err
+					}
+				}
+
+				err = f.checkImagesExist(ctx, ecrClients, baseTaskDef, l)
+				if err != nil {
+					return err
+				}
+
+				newTaskDef, err = f.createNewTaskDefinition(uniqueID, baseTaskDef)
+				if err != nil {
+					return err
+				}
+
+				_, tagSpan := tracing.Start(ctx, "re-tag", tracing.Service(f.cluster, f.serviceName)...)
+				digests, err = f.tagImages(ctx, ecrClients, baseTaskDef, uniqueID, l)
+				tracing.End(tagSpan, err)
+				if err != nil {
+					return err
+				}
+			}
+
+			if f.family != "" {
+				v := *newTaskDef // shallow copy
+				v.Family = aws.String(f.family)
+				newTaskDef = &v
+			}
+
+			newTaskDef, err = f.overrideContainerResources(newTaskDef)
+			if err != nil {
+				return err
+			}
+
+			var tags []*ecs.Tag
+			if len(f.tags.Value) > 0 {
+				currentTags, err := libecs.DescribeTaskDefinitionTags(ctx, client, *taskDef.TaskDefinitionArn)
+				if err != nil {
+					return err
+				}
+				tags = mergeTags(currentTags, f.tags.Value)
+			}
+
+			l.Debug(fmt.Sprintf("register task definition %s\n", *newTaskDef.Family))
+			_, registerSpan := tracing.Start(ctx, "register", tracing.Service(f.cluster, f.serviceName)...)
+			registerdTaskDef, err = libecs.RegisterTaskDefinition(ctx, client, newTaskDef, tags)
+			if err == nil {
+				registerSpan.SetAttributes(tracing.Revision(*registerdTaskDef.Revision))
+			}
+			tracing.End(registerSpan, err)
+			if err != nil {
+				return err
+			}
+			f.registeredTaskDefArn = *registerdTaskDef.TaskDefinitionArn
+		}
+		f.result.ToRevision = *registerdTaskDef.Revision
+		f.result.TaskDefArn = *registerdTaskDef.TaskDefinitionArn
+		f.result.Images = newImageChanges(taskDef, registerdTaskDef)
+	}
+
+	span.SetAttributes(tracing.Revision(*registerdTaskDef.Revision))
+
+	if f.registerOnly {
+		err = historyManager.PushState(
+			int(*registerdTaskDef.Revision),
+			deployStatus_PENDING,
+			fmt.Sprintf("register: %d -> %d", *taskDef.Revision, *registerdTaskDef.Revision),
+		)
+		if err != nil {
+			return err
+		}
+
+		err = setDigests(historyManager, int(*registerdTaskDef.Revision), digests)
+		if err != nil {
+			return err
+		}
+
+		l.Log(fmt.Sprintf("registered %s\n", *registerdTaskDef.TaskDefinitionArn))
+		l.Log(fmt.Sprintf("run `shipctl deploy --update-only --revision %d` to update the service\n", *registerdTaskDef.Revision))
+		l.Result(fmt.Sprintf("%d\n", *registerdTaskDef.Revision))
+		return nil
+	}
+
+	if *registerdTaskDef.Family != *taskDef.Family && !f.updateService {
+		l.Log(fmt.Sprintf("registered %s\n", *registerdTaskDef.TaskDefinitionArn))
+		l.Log(fmt.Sprintf("the service is not updated because the family differs from %s. pass --update-service to update it\n", *taskDef.Family))
+		return nil
+	}
+
+	var msg string
+	msg = fmt.Sprintf("deploy: revision %d -> %d\n", *taskDef.Revision, *registerdTaskDef.Revision)
+	msg += digestsMessage(digests)
+	l.Log(msg)
+	l.Slack("normal", msg)
+
+	err = f.putSSMParameters(ctx, ssmClient, f.preDeploySSM.Value, l)
+	if err != nil {
+		return err
+	}
+
+	var deploymentID string
+	_, updateSpan := tracing.Start(ctx, "update", tracing.Service(f.cluster, f.serviceName)...)
+	updateSpan.SetAttributes(tracing.Revision(*registerdTaskDef.Revision))
+	if isCodeDeploy {
+		application, deploymentGroup := f.codedeployNames()
+		l.Debug(fmt.Sprintf("create deployment of %s/%s to %s\n", application, deploymentGroup, *registerdTaskDef.TaskDefinitionArn))
+		deploymentID, err = libcodedeploy.CreateDeployment(ctx, codedeployClient, application, deploymentGroup, service, registerdTaskDef)
+		tracing.End(updateSpan, err)
+		if err != nil {
+			return err
+		}
+		l.Log(fmt.Sprintf("created CodeDeploy deployment %s\n", deploymentID))
+	} else {
+		l.Debug(fmt.Sprintf("update service %s to %s\n", f.serviceName, *registerdTaskDef.TaskDefinitionArn))
+		err = libecs.UpdateService(ctx, client, service, registerdTaskDef, &libecs.UpdateServiceOptions{
+			CapacityProviderStrategy: f.capacityProviders.Value,
+			PropagateTags:            f.propagateTags,
+			EnableECSManagedTags:     f.enableManagedTags,
+			ForceNewDeployment:       f.forceNewDeployment,
+			PlatformVersion:          f.platformVersion,
+			DesiredCount:             f.canaryCount,
+			MaximumPercent:           optionalInt64(f.maxPercent),
+			MinimumHealthyPercent:    optionalInt64(f.minHealthyPercent),
+		})
+		tracing.End(updateSpan, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	cause := fmt.Sprintf("deploy: %d -> %d", *taskDef.Revision, *registerdTaskDef.Revision)
+	switch {
+	case f.updateOnly && len(states) > 0 && states[len(states)-1].Revision == int(*registerdTaskDef.Revision) && states[len(states)-1].Status == deployStatus_PENDING:
+		// the PENDING state is already recorded by --register-only
+	case f.canaryCount > 0:
+		err = historyManager.PushCanaryState(int(*registerdTaskDef.Revision), *service.DesiredCount, cause+" (canary)")
+	default:
+		err = historyManager.PushState(int(*registerdTaskDef.Revision), deployStatus_PENDING, cause)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = setDigests(historyManager, int(*registerdTaskDef.Revision), digests)
+	if err != nil {
+		return err
+	}
+
+	if f.detach {
+		l.Log(fmt.Sprintf("detached. run `shipctl deploy-status --revision %d` to wait for completion\n", *registerdTaskDef.Revision))
+		l.Result(fmt.Sprintf("%d\n", *registerdTaskDef.Revision))
+		return nil
+	}
+
+	l.Log(fmt.Sprintf("service updating\n"))
+
+	_, waitSpan := tracing.Start(ctx, "wait", tracing.Service(f.cluster, f.serviceName)...)
+	waitSpan.SetAttributes(tracing.Revision(*registerdTaskDef.Revision))
+	if isCodeDeploy {
+		l.Debug(fmt.Sprintf("wait for deployment %s to succeed\n", deploymentID))
+		err = libcodedeploy.WaitDeployment(ctx, codedeployClient, deploymentID, l)
+	} else {
+		l.Debug(fmt.Sprintf("wait for service %s to be stable\n", f.serviceName))
+		err = libecs.WaitUpdateService(ctx, client, f.cluster, f.serviceName, f.waitForSteadyState, l)
+	}
+	tracing.End(waitSpan, err)
+	if err != nil {
+		err = newDeployFailure(err)
+		if ctx.Err() != nil {
+			l.Log(fmt.Sprintf("deploy was cancelled. revision %d is left PENDING in history\n", *registerdTaskDef.Revision))
+			l.Log(fmt.Sprintf("run `shipctl deploy-status --revision %d` to resume waiting, or `shipctl rollback` to rollback\n", *registerdTaskDef.Revision))
+			return err
+		}
+
+		if f.autoRollback && *registerdTaskDef.TaskDefinitionArn != *taskDef.TaskDefinitionArn {
+			msg = fmt.Sprintf("auto-rollback: revision %d -> %d\n", *registerdTaskDef.Revision, *taskDef.Revision)
+			l.Log(msg)
+			l.Slack("normal", msg)
+
+			rerr := rollbackService(
+				ctx, client, historyManager, f.cluster, service, taskDef,
+				fmt.Sprintf("auto-rollback: %d -> %d", *registerdTaskDef.Revision, *taskDef.Revision),
+				l,
+			)
+			if rerr != nil {
+				return &rollbackFailure{err: errors.New(fmt.Sprintf("failed to deploy: %s\nfailed to rollback: %s", err.Error(), rerr.Error()))}
+			}
+			return newDeployFailure(errors.New(fmt.Sprintf("failed to deploy and rolled back to revision %d: %s", *taskDef.Revision, err.Error())))
+		}
+		return err
+	}
+
+	service, err = libecs.DescribeService(ctx, client, f.cluster, f.serviceName)
+	if err != nil {
+		return err
+	}
+	f.result.RunningCount = *service.RunningCount
+	f.result.DesiredCount = *service.DesiredCount
+
+	if f.canaryCount > 0 {
+		err = historyManager.UpdateState(int(*registerdTaskDef.Revision), deployStatus_CANARY)
+		if err != nil {
+			return err
+		}
+
+		msg = fmt.Sprintf("canary is running with %d tasks. run deploy --promote to scale it to %d tasks\n", f.canaryCount, *service.DesiredCount)
+		l.Status("good", msg)
+		l.Slack("good", msg)
+		return nil
+	}
+
+	err = historyManager.UpdateState(int(*registerdTaskDef.Revision), deployStatus_DEPLOYED)
+	if err != nil {
+		return err
+	}
+
+	err = f.putSSMParameters(ctx, ssmClient, f.postDeploySSM.Value, l)
+	if err != nil {
+		return err
+	}
+
+	if f.promoteTag != "" {
+		err = f.promoteImages(ctx, ecrClients, registerdTaskDef, l)
+		if err != nil {
+			return fmt.Errorf("the service is updated, but failed to promote images: %w", err)
+		}
+	}
+
+	if f.pruneOldRevisions > 0 {
+		err = f.pruneTaskDefinitions(ctx, client, historyManager, service, *registerdTaskDef.Family, l)
+		if err != nil {
+			// the service is already updated, so pruning failures are not fatal
+			l.Log(fmt.Sprintf("failed to prune old revisions: %s\n", err.Error()))
+		}
+	}
+
+	msg = fmt.Sprintf("successfully updated. unique ID: %s\n", uniqueID)
+	l.Status("good", msg)
+	l.Slack("good", msg)
+
+	return nil
+}
+
+// validate checks the combination of the flags before any AWS API is called
+func (f *deployCmd) validate() error {
+	_, _, err := f.containerResources()
+	if err != nil {
+		return err
+	}
+	hasResources := len(f.containerCPU.Value) > 0 || len(f.containerMemory.Value) > 0
+
+	if f.promote {
+		if len(f.images.Value) > 0 || f.taskTemplate != "" || f.revision > 0 || f.canaryCount > 0 || hasResources {
+			return errors.New("--promote can not be used with --image, --task-template, --revision, --canary-count nor --container-cpu/--container-memory")
+		}
+	} else if f.updateOnly {
+		if f.revision <= 0 {
+			return errors.New("--update-only requires --revision")
+		}
+		if len(f.images.Value) > 0 || f.taskTemplate != "" || f.family != "" || f.registerOnly || hasResources {
+			return errors.New("--update-only can not be used with --image, --task-template, --family, --register-only nor --container-cpu/--container-memory")
+		}
+	} else if f.registerOnly {
+		if len(f.images.Value) == 0 && f.taskTemplate == "" && f.family == "" && !hasResources {
+			return errors.New("--register-only requires --image, --task-template, --family or --container-cpu/--container-memory")
+		}
+	} else if len(f.images.Value) == 0 && !f.forceNewDeployment && f.taskTemplate == "" && !hasResources && !(f.createIfMissing && f.family != "") {
+		return errors.New("--image is required")
+	}
+
+	if f.canaryCount < 0 {
+		return errors.New("--canary-count must not be negative")
+	}
+
+	if f.canaryCount > 0 && f.detach {
+		return errors.New("--canary-count can not be used with --detach")
+	}
+
+	if f.taskTemplate != "" && f.revision > 0 {
+		return errors.New("--task-template and --revision are mutually exclusive")
+	}
+
+	if f.valuesFile != "" && f.taskTemplate == "" {
+		return errors.New("--values requires --task-template")
+	}
+
+	if f.maxPercent < -1 || f.maxPercent == 0 {
+		return errors.New("--max-percent must be positive")
+	}
+
+	if f.minHealthyPercent < -1 || f.minHealthyPercent > 100 {
+		return errors.New("--min-healthy-percent must be between 0 and 100")
+	}
+
+	if f.pruneOldRevisions < 0 {
+		return errors.New("--prune-old-revisions must not be negative")
+	}
+
+	if f.detach && len(f.postDeploySSM.Value) > 0 {
+		return errors.New("--post-deploy-ssm can not be used with --detach")
+	}
+
+	if f.promoteTag != "" {
+		if !regexp.MustCompile(`^[\w][\w.-]{0,127}$`).MatchString(f.promoteTag) {
+			return errors.New(fmt.Sprintf("invalid --promote-tag %s", f.promoteTag))
+		}
+		if f.detach {
+			return errors.New("--promote-tag can not be used with --detach")
+		}
+	}
+
+	if f.requireImmutableTags && f.promoteTag != "" {
+		return errors.New("--require-immutable-tags can not be used with --promote-tag, since the floating tag can not be moved in immutable repositories")
+	}
+
+	if f.detach && f.autoRollback {
+		return errors.New("--auto-rollback can not be used with --detach")
+	}
+
+	if f.createIfMissing {
+		if f.desiredCount < 0 {
+			return errors.New("--desired-count must not be negative")
+		}
+		if f.desiredCount == 0 && !f.allowZeroDesired {
+			return errors.New("--desired-count is 0. pass --allow-zero-desired to create the service anyway")
+		}
+		if f.promote || f.updateOnly || f.registerOnly || f.canaryCount > 0 {
+			return errors.New("--create-if-missing can not be used with --promote, --update-only, --register-only nor --canary-count")
+		}
+	}
+
+	switch f.launchType {
+	case "", ecs.LaunchTypeEc2, ecs.LaunchTypeFargate, ecs.LaunchTypeExternal:
+	default:
+		return errors.New(fmt.Sprintf("invalid --launch-type %s", f.launchType))
+	}
+
+	if f.launchType != "" && len(f.capacityProviders.Value) > 0 {
+		return errors.New("--launch-type and --capacity-provider are mutually exclusive")
+	}
+
+	if f.platformVersion != "" && f.launchType == ecs.LaunchTypeEc2 {
+		return errors.New("--platform-version is not supported on EC2")
+	}
+
+	switch f.assignPublicIP {
+	case "", ecs.AssignPublicIpEnabled, ecs.AssignPublicIpDisabled:
+	default:
+		return errors.New(fmt.Sprintf("invalid --assign-public-ip %s", f.assignPublicIP))
+	}
+
+	switch f.propagateTags {
+	case "", ecs.PropagateTagsService, ecs.PropagateTagsTaskDefinition, ecs.PropagateTagsNone:
+	default:
+		return errors.New(fmt.Sprintf("invalid --propagate-tags %s", f.propagateTags))
+	}
+
+	return nil
+}
+
+// createService registers the task definition of --task-template or --family and creates the service with it,
+// since a missing service has no task definition to deploy from
+func (f *deployCmd) createService(ctx context.Context, client libecs.ECSAPI, ecrClients *ecrClients, historyManager historyManager, uniqueID string, l *log.Logger) error {
+	var baseTaskDef *ecs.TaskDefinition
+	var err error
+	if f.taskTemplate != "" {
+		baseTaskDef, err = renderTaskDefinition(f.taskTemplate, f.valuesFile)
+	} else if f.family != "" {
+		l.Debug(fmt.Sprintf("describe task definition %s\n", f.family))
+		baseTaskDef, err = libecs.DescribeTaskDefinition(ctx, client, f.family)
+	} else {
+		return errors.New(fmt.Sprintf("%s is not found. --create-if-missing requires --task-template or --family", f.serviceName))
+	}
+	if err != nil {
+		return err
+	}
+
+	taskDef := baseTaskDef
+	var digests map[string]string
+	if len(f.images.Value) > 0 || f.taskTemplate != "" || len(f.tags.Value) > 0 || len(f.containerCPU.Value) > 0 || len(f.containerMemory.Value) > 0 {
+		newTaskDef := baseTaskDef
+		if len(f.images.Value) > 0 {
+			if f.requireImmutableTags {
+				err = f.checkImmutableTags(ctx, ecrClients, baseTaskDef, l)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = f.checkImagesExist(ctx, ecrClients, baseTaskDef, l)
+			if err != nil {
+				return err
+			}
+
+			newTaskDef, err = f.createNewTaskDefinition(uniqueID, baseTaskDef)
+			if err != nil {
+				return err
+			}
+
+			_, tagSpan := tracing.Start(ctx, "re-tag", tracing.Service(f.cluster, f.serviceName)...)
+			digests, err = f.tagImages(ctx, ecrClients, baseTaskDef, uniqueID, l)
+			tracing.End(tagSpan, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		if f.family != "" {
+			v := *newTaskDef // shallow copy
+			v.Family = aws.String(f.family)
+			newTaskDef = &v
+		}
+
+		newTaskDef, err = f.overrideContainerResources(newTaskDef)
+		if err != nil {
+			return err
+		}
+
+		l.Debug(fmt.Sprintf("register task definition %s\n", *newTaskDef.Family))
+		_, registerSpan := tracing.Start(ctx, "register", tracing.Service(f.cluster, f.serviceName)...)
+		taskDef, err = libecs.RegisterTaskDefinition(ctx, client, newTaskDef, mergeTags(nil, f.tags.Value))
+		if err == nil {
+			registerSpan.SetAttributes(tracing.Revision(*taskDef.Revision))
+		}
+		tracing.End(registerSpan, err)
+		if err != nil {
+			return err
+		}
+		f.registeredTaskDefArn = *taskDef.TaskDefinitionArn
+	}
+	f.result.ToRevision = *taskDef.Revision
+	f.result.TaskDefArn = *taskDef.TaskDefinitionArn
+
+	msg := fmt.Sprintf("create: service %s with revision %d\n", f.serviceName, *taskDef.Revision)
+	msg += digestsMessage(digests)
+	l.Log(msg)
+	l.Slack("normal", msg)
+
+	l.Debug(fmt.Sprintf("create service %s with %s\n", f.serviceName, *taskDef.TaskDefinitionArn))
+	_, updateSpan := tracing.Start(ctx, "update", tracing.Service(f.cluster, f.serviceName)...)
+	updateSpan.SetAttributes(tracing.Revision(*taskDef.Revision))
+	err = libecs.CreateService(ctx, client, f.cluster, f.serviceName, taskDef, &libecs.CreateServiceOptions{
+		DesiredCount:             f.desiredCount,
+		LaunchType:               f.launchType,
+		CapacityProviderStrategy: f.capacityProviders.Value,
+		Subnets:                  f.subnets,
+		SecurityGroups:           f.securityGroups,
+		AssignPublicIP:           f.assignPublicIP,
+		PropagateTags:            f.propagateTags,
+		EnableECSManagedTags:     f.enableManagedTags,
+		PlatformVersion:          f.platformVersion,
+		MaximumPercent:           optionalInt64(f.maxPercent),
+		MinimumHealthyPercent:    optionalInt64(f.minHealthyPercent),
+	})
+	tracing.End(updateSpan, err)
+	if err != nil {
+		return err
+	}
+
+	err = historyManager.PushState(int(*taskDef.Revision), deployStatus_PENDING, fmt.Sprintf("create: %d", *taskDef.Revision))
+	if err != nil {
+		return err
+	}
+
+	err = setDigests(historyManager, int(*taskDef.Revision), digests)
+	if err != nil {
+		return err
+	}
+
+	if f.detach {
+		l.Log(fmt.Sprintf("detached. run `shipctl deploy-status --revision %d` to wait for completion\n", *taskDef.Revision))
+		l.Result(fmt.Sprintf("%d\n", *taskDef.Revision))
+		return nil
+	}
+
+	l.Log(fmt.Sprintf("service creating\n"))
+
+	l.Debug(fmt.Sprintf("wait for service %s to be stable\n", f.serviceName))
+	_, waitSpan := tracing.Start(ctx, "wait", tracing.Service(f.cluster, f.serviceName)...)
+	waitSpan.SetAttributes(tracing.Revision(*taskDef.Revision))
+	err = libecs.WaitUpdateService(ctx, client, f.cluster, f.serviceName, f.waitForSteadyState, l)
+	tracing.End(waitSpan, err)
+	if err != nil {
+		return newDeployFailure(err)
+	}
+
+	err = historyManager.UpdateState(int(*taskDef.Revision), deployStatus_DEPLOYED)
+	if err != nil {
+		return err
+	}
+
+	msg = fmt.Sprintf("successfully created. unique ID: %s\n", uniqueID)
+	l.Status("good", msg)
+	l.Slack("good", msg)
+
+	return nil
+}
+
+// tagImages tags the ECR images of --image in the task definition with the unique tag,
+// and returns the digests of the images by repository names
+func (f *deployCmd) tagImages(ctx context.Context, ecrClients *ecrClients, taskDef *ecs.TaskDefinition, uniqueID string, l *log.Logger) (map[string]string, error) {
+	digests := map[string]string{}
+	for _, v := range taskDef.ContainerDefinitions {
+		img, err := f.parseDockerImage(*v.Image)
+		if err != nil {
+			return nil, err
+		}
+
+		if img.Digest != "" {
+			continue
+		}
+
+		opt := f.images.Get(img.RepositoryName)
+		if opt == nil {
+			return nil, errors.New(fmt.Sprintf("can not found image option %s", img.RepositoryName))
 		}
 
-		newTaskDef, err := f.createNewTaskDefinition(uniqueID, taskDef)
+		digest, err := f.tagDockerImage(ctx, ecrClients.get(img.Region), img.RepositoryName, opt.Tag, uniqueID)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		l.Log(fmt.Sprintf("image %s:%s is %s\n", img.RepositoryName, uniqueID, digest))
+		digests[img.RepositoryName] = digest
+	}
 
-		for _, v := range taskDef.ContainerDefinitions {
-			img, err := f.parseDockerImage(*v.Image)
-			if err != nil {
-				return err
-			}
-
-			opt := f.images.Get(img.RepositoryName)
-			if opt == nil {
-				return errors.New(fmt.Sprintf("can not found image option %s", img.RepositoryName))
-			}
+	return digests, nil
+}
 
-			err = f.tagDockerImage(ecrClient, img.RepositoryName, opt.Tag, uniqueID)
-			if err != nil {
-				return err
-			}
+// repositoryRegion returns the region of the ECR repository referenced by the task definition.
+// empty means the region of the cluster
+func (f *deployCmd) repositoryRegion(taskDef *ecs.TaskDefinition, repoName string) string {
+	for _, v := range taskDef.ContainerDefinitions {
+		img, err := f.parseDockerImage(aws.StringValue(v.Image))
+		if err == nil && img.RepositoryName == repoName && f.isECRHosted(img) {
+			return img.Region
 		}
+	}
+	return ""
+}
 
-		registerdTaskDef, err = f.registerTaskDefinition(client, newTaskDef)
+// checkImmutableTags returns an error listing the repositories of --image without tag immutability
+func (f *deployCmd) checkImmutableTags(ctx context.Context, ecrClients *ecrClients, taskDef *ecs.TaskDefinition, l *log.Logger) error {
+	var mutable []string
+	for _, v := range f.images.Value {
+		l.Debug(fmt.Sprintf("describe repository %s\n", v.RepositoryName))
+		res, err := ecrClients.get(f.repositoryRegion(taskDef, v.RepositoryName)).DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+			RepositoryNames: []*string{aws.String(v.RepositoryName)},
+		})
 		if err != nil {
-			return err
+			return awsutil.WrapError(err)
 		}
-	}
 
-	var msg string
-	msg = fmt.Sprintf("deploy: revision %d -> %d\n", *taskDef.Revision, *registerdTaskDef.Revision)
-	l.Log(msg)
-	l.Slack("normal", msg)
+		for _, repo := range res.Repositories {
+			if aws.StringValue(repo.ImageTagMutability) != ecr.ImageTagMutabilityImmutable {
+				mutable = append(mutable, fmt.Sprintf("    %s: %s\n", v.RepositoryName, aws.StringValue(repo.ImageTagMutability)))
+			}
+		}
+	}
 
-	err = libecs.UpdateService(client, service, registerdTaskDef)
-	if err != nil {
-		return err
+	if len(mutable) > 0 {
+		return errors.New("tag immutability is not enabled for repositories. --require-immutable-tags requires IMMUTABLE\n" + strings.Join(mutable, ""))
 	}
+	return nil
+}
 
-	l.Log(fmt.Sprintf("service updating\n"))
+// checkImagesExist returns an error listing the images of --image whose tags are not found in ECR.
+// each image is looked up in the region of the repository referenced by the task definition
+func (f *deployCmd) checkImagesExist(ctx context.Context, ecrClients *ecrClients, taskDef *ecs.TaskDefinition, l *log.Logger) error {
+	var missing []string
+	for _, v := range f.images.Value {
+		region := f.repositoryRegion(taskDef, v.RepositoryName)
 
-	err = libecs.WaitUpdateService(client, f.cluster, f.serviceName, l)
-	if err != nil {
-		return err
-	}
+		l.Debug(fmt.Sprintf("check image %s:%s\n", v.RepositoryName, v.Tag))
+		img, err := ecrClients.get(region).BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(v.Tag)}},
+			RepositoryName: aws.String(v.RepositoryName),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeRepositoryNotFoundException {
+			missing = append(missing, fmt.Sprintf("    %s:%s: repository not found\n", v.RepositoryName, v.Tag))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get image %s:%s: %w", v.RepositoryName, v.Tag, awsutil.WrapError(err))
+		}
 
-	err = historyManager.PushState(
-		int(*registerdTaskDef.Revision),
-		fmt.Sprintf("deploy: %d -> %d", *taskDef.Revision, *registerdTaskDef.Revision),
-	)
-	if err != nil {
-		return err
+		if len(img.Images) == 0 {
+			reason := "tag not found"
+			for _, w := range img.Failures {
+				reason = aws.StringValue(w.FailureReason)
+			}
+			missing = append(missing, fmt.Sprintf("    %s:%s: %s\n", v.RepositoryName, v.Tag, reason))
+		}
 	}
 
-	msg = fmt.Sprintf("successfully updated\n")
-	l.Log(msg)
-	l.Slack("good", msg)
-
+	if len(missing) > 0 {
+		return errors.New("images are not found in ECR\n" + strings.Join(missing, ""))
+	}
 	return nil
 }
 
@@ -197,7 +1234,10 @@ func (f *deployCmd) createNewTaskDefinition(id string, taskDef *ecs.TaskDefiniti
 			return nil, err
 		}
 
-		if f.isECRHosted(img) {
+		if img.Digest != "" {
+			// digest-pinned images are kept as is
+			containers = append(containers, &v)
+		} else if f.isECRHosted(img) {
 			v.Image = aws.String(fmt.Sprintf("%s:%s", img.Name, id))
 			containers = append(containers, &v)
 		}
@@ -207,11 +1247,77 @@ func (f *deployCmd) createNewTaskDefinition(id string, taskDef *ecs.TaskDefiniti
 	return &newTaskDef, nil
 }
 
+// containerResources parses --container-cpu and --container-memory by container names
+func (f *deployCmd) containerResources() (map[string]int64, map[string]int64, error) {
+	parse := func(name string, opts keyValueOptions) (map[string]int64, error) {
+		values := map[string]int64{}
+		for _, v := range opts.Value {
+			n, err := strconv.ParseInt(v.Value, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, errors.New(fmt.Sprintf("invalid --%s %s=%s. must be a positive integer", name, v.Key, v.Value))
+			}
+			values[v.Key] = n
+		}
+		return values, nil
+	}
+
+	cpus, err := parse("container-cpu", f.containerCPU)
+	if err != nil {
+		return nil, nil, err
+	}
+	memories, err := parse("container-memory", f.containerMemory)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cpus, memories, nil
+}
+
+// overrideContainerResources sets the CPU and memory of the containers of --container-cpu and --container-memory
+func (f *deployCmd) overrideContainerResources(taskDef *ecs.TaskDefinition) (*ecs.TaskDefinition, error) {
+	cpus, memories, err := f.containerResources()
+	if err != nil {
+		return nil, err
+	}
+	if len(cpus) == 0 && len(memories) == 0 {
+		return taskDef, nil
+	}
+
+	names := map[string]bool{}
+	newTaskDef := *taskDef // shallow copy
+	var containers []*ecs.ContainerDefinition
+	for _, vp := range taskDef.ContainerDefinitions {
+		v := *vp // shallow copy
+		name := aws.StringValue(v.Name)
+		names[name] = true
+		if cpu, ok := cpus[name]; ok {
+			v.Cpu = aws.Int64(cpu)
+		}
+		if memory, ok := memories[name]; ok {
+			v.Memory = aws.Int64(memory)
+		}
+		containers = append(containers, &v)
+	}
+	newTaskDef.ContainerDefinitions = containers
+
+	for _, values := range []map[string]int64{cpus, memories} {
+		for name := range values {
+			if !names[name] {
+				return nil, errors.New(fmt.Sprintf("container %s is not found in task definition %s", name, aws.StringValue(taskDef.Family)))
+			}
+		}
+	}
+
+	return &newTaskDef, nil
+}
+
 type dockerImage struct {
 	Name           string
 	Tag            string
+	Digest         string
 	RepositoryName string
 	HostName       string
+	// Region is the region of the ECR repository. empty if the image is not hosted in ECR
+	Region string
 }
 
 func (f *deployCmd) parseDockerImage(image string) (*dockerImage, error) {
@@ -220,42 +1326,200 @@ func (f *deployCmd) parseDockerImage(image string) (*dockerImage, error) {
 		return nil, err
 	}
 
-	hostName, repoName := reference.SplitHostname(ref.(reference.Named))
-	return &dockerImage{
-		Name:           ref.(reference.Named).Name(),
-		Tag:            ref.(reference.Tagged).Tag(),
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("repository name is not found in image %s", image))
+	}
+
+	// an untagged image means :latest
+	named = reference.TagNameOnly(named)
+
+	hostName, repoName := reference.SplitHostname(named)
+	img := &dockerImage{
+		Name:           named.Name(),
 		RepositoryName: repoName,
 		HostName:       hostName,
-	}, nil
+	}
+
+	if matches := ECRRegex.FindStringSubmatch(hostName); len(matches) > 0 {
+		img.Region = matches[1]
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		img.Tag = tagged.Tag()
+	}
+
+	if digested, ok := named.(reference.Digested); ok {
+		img.Digest = digested.Digest().String()
+	}
+
+	return img, nil
 }
 
 func (f *deployCmd) isECRHosted(image *dockerImage) bool {
 	return ECRRegex.MatchString(image.HostName)
 }
 
-func (f *deployCmd) registerTaskDefinition(client *ecs.ECS, taskDef *ecs.TaskDefinition) (*ecs.TaskDefinition, error) {
-	params := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    taskDef.ContainerDefinitions,
-		Cpu:                     taskDef.Cpu,
-		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
-		Family:                  taskDef.Family,
-		Memory:                  taskDef.Memory,
-		NetworkMode:             taskDef.NetworkMode,
-		PlacementConstraints:    taskDef.PlacementConstraints,
-		TaskRoleArn:             taskDef.TaskRoleArn,
-		Volumes:                 taskDef.Volumes,
-		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+// ECRAPI is the subset of the ECR client used by deploy
+type ECRAPI interface {
+	BatchGetImageWithContext(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
+	PutImageWithContext(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	DescribeRepositoriesWithContext(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error)
+}
+
+// ecrClients creates ECR clients by regions, since repositories may be in other regions than the cluster
+type ecrClients struct {
+	sess    *session.Session
+	awsOpts *awsOptions
+	region  string
+	clients map[string]ECRAPI
+}
+
+func newECRClients(sess *session.Session, awsOpts *awsOptions, region string) *ecrClients {
+	return &ecrClients{
+		sess:    sess,
+		awsOpts: awsOpts,
+		region:  region,
+		clients: map[string]ECRAPI{},
+	}
+}
+
+// get returns the client of the region. empty means the region of the cluster
+func (c *ecrClients) get(region string) ECRAPI {
+	if region == "" {
+		region = c.region
+	}
+	if _, ok := c.clients[region]; !ok {
+		c.clients[region] = ecr.New(c.sess, c.awsOpts.config(region))
+	}
+	return c.clients[region]
+}
+
+// cleanupTaskDefinition deregisters the task definition registered by a failed deploy.
+// it is kept if it is marked DEPLOYED in history or used by a deployment of the service, e.g. an interrupted rollout
+func (f *deployCmd) cleanupTaskDefinition(arn string, l *log.Logger) error {
+	// the context of the deploy may be cancelled by the interruption
+	ctx := context.Background()
+
+	revision, err := libecs.RevisionOf(arn)
+	if err != nil {
+		return err
 	}
 
-	res, err := client.RegisterTaskDefinition(params)
+	region := f.awsOpts.resolveRegion()
+	sess, err := newAWSSession(&f.awsOpts)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName, &f.awsOpts, &f.historyOpts)
+	if err != nil {
+		return err
+	}
+	states, err := historyManager.Pull()
+	if err != nil {
+		return err
+	}
+	for _, v := range states {
+		if v.Revision == revision && v.Status == deployStatus_DEPLOYED {
+			l.Log(fmt.Sprintf("keep %s. it is deployed in history\n", arn))
+			return nil
+		}
+	}
+
+	service, err := libecs.DescribeService(ctx, client, f.cluster, f.serviceName)
+	if err != nil && err != libecs.ErrServiceNotFound {
+		return err
+	}
+	if service != nil {
+		for _, d := range service.Deployments {
+			if aws.StringValue(d.TaskDefinition) == arn {
+				l.Log(fmt.Sprintf("keep %s. it is used by deployment %s of the service\n", arn, aws.StringValue(d.Id)))
+				return nil
+			}
+		}
+	}
+
+	l.Debug(fmt.Sprintf("deregister task definition %s\n", arn))
+	err = libecs.DeregisterTaskDefinition(ctx, client, arn)
+	if err != nil {
+		return err
+	}
+	l.Log(fmt.Sprintf("deregistered %s registered by the failed deploy\n", arn))
+
+	return nil
+}
+
+// pruneTaskDefinitions deregisters revisions older than the newest f.pruneOldRevisions,
+// except for revisions in history or in deployments of the service.
+func (f *deployCmd) pruneTaskDefinitions(ctx context.Context, client libecs.ECSAPI, historyManager historyManager, service *ecs.Service, family string, l *log.Logger) error {
+	keep := map[int]bool{}
+
+	states, err := historyManager.Pull()
+	if err != nil {
+		return err
+	}
+	for _, v := range states {
+		keep[v.Revision] = true
+	}
+
+	for _, v := range service.Deployments {
+		revision, err := libecs.RevisionOf(*v.TaskDefinition)
+		if err != nil {
+			return err
+		}
+		keep[revision] = true
+	}
+
+	arns, err := libecs.ListTaskDefinitions(ctx, client, family, ecs.TaskDefinitionStatusActive)
+	if err != nil {
+		return err
+	}
+
+	if len(arns) <= f.pruneOldRevisions {
+		return nil
+	}
+
+	for _, arn := range arns[f.pruneOldRevisions:] {
+		revision, err := libecs.RevisionOf(arn)
+		if err != nil {
+			return err
+		}
+		if keep[revision] {
+			continue
+		}
+
+		err = libecs.DeregisterTaskDefinition(ctx, client, arn)
+		if err != nil {
+			return err
+		}
+		l.Log(fmt.Sprintf("deregistered %s\n", arn))
+	}
+
+	return nil
+}
+
+func (f *deployCmd) putSSMParameters(ctx context.Context, client *ssm.SSM, params []*keyValue, l *log.Logger) error {
+	for _, v := range params {
+		p := &ssm.PutParameterInput{
+			Name:      aws.String(v.Key),
+			Type:      aws.String("String"),
+			Value:     aws.String(v.Value),
+			Overwrite: aws.Bool(true),
+		}
+		_, err := client.PutParameterWithContext(ctx, p)
+		if err != nil {
+			return awsutil.WrapError(err)
+		}
+		l.Log(fmt.Sprintf("put SSM parameter: %s=%s\n", v.Key, v.Value))
 	}
 
-	return res.TaskDefinition, nil
+	return nil
 }
 
-func (f *deployCmd) tagDockerImage(ecrClient *ecr.ECR, repoName string, fromTag string, toTag string) error {
+// tagDockerImage tags the image of fromTag as toTag, and returns the digest of the image
+func (f *deployCmd) tagDockerImage(ctx context.Context, ecrClient ECRAPI, repoName string, fromTag string, toTag string) (string, error) {
 	params := &ecr.BatchGetImageInput{
 		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(fromTag)}},
 		RepositoryName: aws.String(repoName),
@@ -266,21 +1530,137 @@ func (f *deployCmd) tagDockerImage(ecrClient *ecr.ECR, repoName string, fromTag
 			aws.String("application/vnd.oci.image.manifest.v1+json"),
 		},
 	}
-	img, err := ecrClient.BatchGetImage(params)
+	img, err := ecrClient.BatchGetImageWithContext(ctx, params)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to get image %s:%s: %w", repoName, fromTag, awsutil.WrapError(err))
+	}
+
+	if len(img.Failures) > 0 {
+		msg := ""
+		for _, v := range img.Failures {
+			msg += fmt.Sprintf("    %s: %s\n", aws.StringValue(v.FailureCode), aws.StringValue(v.FailureReason))
+		}
+		return "", errors.New(fmt.Sprintf("failed to get image %s:%s\n", repoName, fromTag) + msg)
+	}
+
+	if len(img.Images) == 0 {
+		return "", errors.New(fmt.Sprintf("image tag %s not found in repository %s", fromTag, repoName))
 	}
+	digest := aws.StringValue(img.Images[0].ImageId.ImageDigest)
 
 	putParams := &ecr.PutImageInput{
 		ImageManifest:  img.Images[0].ImageManifest,
 		RepositoryName: aws.String(repoName),
 		ImageTag:       aws.String(toTag),
 	}
-	_, err = ecrClient.PutImage(putParams)
+	_, err = ecrClient.PutImageWithContext(ctx, putParams)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+		// the tag already points to the image
+		return digest, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to tag image %s:%s as %s: %w", repoName, fromTag, toTag, awsutil.WrapError(err))
+	}
+
+	return digest, nil
+}
+
+// promoteCanary scales the canary back to the desired count recorded in history
+func (f *deployCmd) promoteCanary(ctx context.Context, client libecs.ECSAPI, historyManager historyManager, service *ecs.Service, canary *deployState, l *log.Logger) error {
+	currentRevision, err := libecs.RevisionOf(*service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+	if currentRevision != canary.Revision {
+		return errors.New(fmt.Sprintf("history is out of sync with the service. the canary is revision %d but the service is running revision %d", canary.Revision, currentRevision))
+	}
+
+	taskDef, err := libecs.DescribeTaskDefinition(ctx, client, *service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+	f.result.FromRevision = *taskDef.Revision
+	f.result.ToRevision = *taskDef.Revision
+	f.result.TaskDefArn = *taskDef.TaskDefinitionArn
+
+	msg := fmt.Sprintf("promote: revision %d, desired count %d -> %d\n", canary.Revision, *service.DesiredCount, canary.DesiredCount)
+	l.Log(msg)
+	l.Slack("normal", msg)
+
+	l.Debug(fmt.Sprintf("update service %s to desired count %d\n", f.serviceName, canary.DesiredCount))
+	_, updateSpan := tracing.Start(ctx, "update", tracing.Service(f.cluster, f.serviceName)...)
+	updateSpan.SetAttributes(tracing.Revision(*taskDef.Revision))
+	err = libecs.UpdateService(ctx, client, service, taskDef, &libecs.UpdateServiceOptions{
+		DesiredCount: canary.DesiredCount,
+	})
+	tracing.End(updateSpan, err)
+	if err != nil {
+		return err
+	}
+
+	l.Log(fmt.Sprintf("service updating\n"))
+
+	l.Debug(fmt.Sprintf("wait for service %s to be stable\n", f.serviceName))
+	_, waitSpan := tracing.Start(ctx, "wait", tracing.Service(f.cluster, f.serviceName)...)
+	waitSpan.SetAttributes(tracing.Revision(*taskDef.Revision))
+	err = libecs.WaitUpdateService(ctx, client, f.cluster, f.serviceName, f.waitForSteadyState, l)
+	tracing.End(waitSpan, err)
+	if err != nil {
+		return newDeployFailure(err)
+	}
+
+	err = historyManager.UpdateState(canary.Revision, deployStatus_DEPLOYED)
 	if err != nil {
 		return err
 	}
 
+	msg = fmt.Sprintf("successfully promoted\n")
+	l.Status("good", msg)
+	l.Slack("good", msg)
+
+	return nil
+}
+
+// codedeployNames returns the CodeDeploy application and deployment group,
+// which are named after the cluster and the service by default as the ECS console creates them
+func (f *deployCmd) codedeployNames() (string, string) {
+	application := f.codedeployApplication
+	if application == "" {
+		application = fmt.Sprintf("AppECS-%s-%s", f.cluster, f.serviceName)
+	}
+
+	deploymentGroup := f.codedeployDeploymentGroup
+	if deploymentGroup == "" {
+		deploymentGroup = fmt.Sprintf("DgpECS-%s-%s", f.cluster, f.serviceName)
+	}
+
+	return application, deploymentGroup
+}
+
+// promoteImages tags the ECR images of the task definition with f.promoteTag
+func (f *deployCmd) promoteImages(ctx context.Context, ecrClients *ecrClients, taskDef *ecs.TaskDefinition, l *log.Logger) error {
+	for _, v := range taskDef.ContainerDefinitions {
+		img, err := f.parseDockerImage(*v.Image)
+		if err != nil {
+			return err
+		}
+
+		if !f.isECRHosted(img) {
+			continue
+		}
+
+		if img.Digest != "" {
+			l.Log(fmt.Sprintf("skip promoting digest-pinned image %s\n", *v.Image))
+			continue
+		}
+
+		_, err = f.tagDockerImage(ctx, ecrClients.get(img.Region), img.RepositoryName, img.Tag, f.promoteTag)
+		if err != nil {
+			return err
+		}
+		l.Log(fmt.Sprintf("promoted %s:%s as %s\n", img.RepositoryName, img.Tag, f.promoteTag))
+	}
+
 	return nil
 }
 
@@ -302,7 +1682,8 @@ func (t *imageOptions) String() string {
 }
 
 func (t *imageOptions) Set(v string) error {
-	r, _ := regexp.Compile(`^([a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*):([\w][\w.-]{0,127})$`)
+	// repository name may have `/`-separated namespaces like team/app
+	r, _ := regexp.Compile(`^([a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*):([\w][\w.-]{0,127})$`)
 	matches := r.FindStringSubmatch(v)
 	if len(matches) == 0 {
 		return errors.New(fmt.Sprintf("invalid format %s", v))
@@ -322,6 +1703,40 @@ func (t *imageOptions) Type() string {
 	return "image"
 }
 
+// LoadFile adds image options from a YAML or JSON file mapping repository names to tags.
+// Repositories already given by --image take precedence.
+func (t *imageOptions) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entries map[string]string
+	err = yaml.Unmarshal(b, &entries)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to parse %s: %s", path, err.Error()))
+	}
+
+	var repoNames []string
+	for k := range entries {
+		repoNames = append(repoNames, k)
+	}
+	sort.Strings(repoNames)
+
+	for _, repoName := range repoNames {
+		if t.Get(repoName) != nil {
+			continue
+		}
+
+		err = t.Set(fmt.Sprintf("%s:%s", repoName, entries[repoName]))
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid entry %s in %s: %s", repoName, path, err.Error()))
+		}
+	}
+
+	return nil
+}
+
 func (t *imageOptions) Get(repoName string) *imageOption {
 	for _, v := range t.Value {
 		if v.RepositoryName == repoName {
@@ -330,3 +1745,51 @@ func (t *imageOptions) Get(repoName string) *imageOption {
 	}
 	return nil
 }
+
+// mergeTags returns the tags overridden by the tags of --tag
+func mergeTags(tags []*ecs.Tag, overrides []*keyValue) []*ecs.Tag {
+	var merged []*ecs.Tag
+	index := map[string]int{}
+	for _, v := range tags {
+		index[aws.StringValue(v.Key)] = len(merged)
+		merged = append(merged, v)
+	}
+
+	for _, v := range overrides {
+		tag := &ecs.Tag{
+			Key:   aws.String(v.Key),
+			Value: aws.String(v.Value),
+		}
+		if i, ok := index[v.Key]; ok {
+			merged[i] = tag
+			continue
+		}
+		index[v.Key] = len(merged)
+		merged = append(merged, tag)
+	}
+
+	return merged
+}
+
+// setDigests records the digests of images in the state of the revision, so that rollback can show the exact images
+func setDigests(historyManager historyManager, revision int, digests map[string]string) error {
+	if len(digests) == 0 {
+		return nil
+	}
+	return historyManager.SetDigests(revision, digests)
+}
+
+// digestsMessage returns lines of images with their digests, sorted by repository names
+func digestsMessage(digests map[string]string) string {
+	var names []string
+	for k := range digests {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	msg := ""
+	for _, v := range names {
+		msg += fmt.Sprintf("image: %s@%s\n", v, digests[v])
+	}
+	return msg
+}
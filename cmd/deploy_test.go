@@ -0,0 +1,442 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+// fakeECR implements ECRAPI by the functions set by a test.
+// methods which are not overridden panic with the nil embedded interface
+type fakeECR struct {
+	ECRAPI
+
+	batchGetImage func(*ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error)
+	putImage      func(*ecr.PutImageInput) (*ecr.PutImageOutput, error)
+}
+
+func (c *fakeECR) BatchGetImageWithContext(_ aws.Context, in *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	return c.batchGetImage(in)
+}
+
+func (c *fakeECR) PutImageWithContext(_ aws.Context, in *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+	return c.putImage(in)
+}
+
+func testLogger() *log.Logger {
+	return log.NewLogger("foo", "bar", nil, ioutil.Discard, ioutil.Discard)
+}
+
+func TestCheckImagesExist(t *testing.T) {
+	tests := []struct {
+		name string
+		res  *ecr.BatchGetImageOutput
+		err  error
+		// want is a part of the error message. empty means no error
+		want string
+	}{
+		{
+			name: "found",
+			res:  &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageManifest: aws.String("{}")}}},
+		},
+		{
+			name: "no images",
+			res:  &ecr.BatchGetImageOutput{},
+			want: "foo:v1: tag not found",
+		},
+		{
+			name: "no images with a failure",
+			res: &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+				FailureCode:   aws.String(ecr.ImageFailureCodeImageNotFound),
+				FailureReason: aws.String("Requested image not found"),
+			}}},
+			want: "foo:v1: Requested image not found",
+		},
+		{
+			name: "repository not found",
+			err:  awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository does not exist", nil),
+			want: "foo:v1: repository not found",
+		},
+	}
+
+	taskDef := &ecs.TaskDefinition{
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Image: aws.String("123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/foo:latest")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &deployCmd{}
+			if err := f.images.Set("foo:v1"); err != nil {
+				t.Fatal(err)
+			}
+
+			var got *ecr.BatchGetImageInput
+			client := &fakeECR{
+				batchGetImage: func(in *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+					got = in
+					return tt.res, tt.err
+				},
+			}
+			clients := &ecrClients{
+				region:  "ap-northeast-1",
+				clients: map[string]ECRAPI{"ap-northeast-1": client},
+			}
+
+			err := f.checkImagesExist(context.Background(), clients, taskDef, testLogger())
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want containing %q", err, tt.want)
+			}
+
+			if aws.StringValue(got.RepositoryName) != "foo" || aws.StringValue(got.ImageIds[0].ImageTag) != "v1" {
+				t.Errorf("unexpected request: %s", got)
+			}
+		})
+	}
+}
+
+func TestImageOptionsSet(t *testing.T) {
+	tests := []struct {
+		value    string
+		repoName string
+		tag      string
+		invalid  bool
+	}{
+		{value: "app:v1", repoName: "app", tag: "v1"},
+		{value: "team/app:v1", repoName: "team/app", tag: "v1"},
+		{value: "org/team/app:v1.2-rc", repoName: "org/team/app", tag: "v1.2-rc"},
+		{value: "org/team_a/my-app:latest", repoName: "org/team_a/my-app", tag: "latest"},
+		{value: "org//app:v1", invalid: true},
+		{value: "/app:v1", invalid: true},
+		{value: "team/app/:v1", invalid: true},
+		{value: "team/app", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var opts imageOptions
+			err := opts.Set(tt.value)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("%s is accepted", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got := opts.Get(tt.repoName)
+			if got == nil {
+				t.Fatalf("repository %s is not found in %v", tt.repoName, opts.Value)
+			}
+			if got.Tag != tt.tag {
+				t.Errorf("tag = %s, want %s", got.Tag, tt.tag)
+			}
+		})
+	}
+}
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseDockerImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  dockerImage
+	}{
+		{
+			image: "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/org/team/app:v1",
+			want: dockerImage{
+				Name:           "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/org/team/app",
+				Tag:            "v1",
+				RepositoryName: "org/team/app",
+				HostName:       "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com",
+				Region:         "ap-northeast-1",
+			},
+		},
+		{
+			image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app:latest",
+			want: dockerImage{
+				Name:           "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app",
+				Tag:            "latest",
+				RepositoryName: "team/app",
+				HostName:       "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+				Region:         "us-east-1",
+			},
+		},
+		{
+			image: "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app@" + testDigest,
+			want: dockerImage{
+				Name:           "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app",
+				Digest:         testDigest,
+				RepositoryName: "app",
+				HostName:       "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com",
+				Region:         "ap-northeast-1",
+			},
+		},
+		{
+			image: "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app:v1@" + testDigest,
+			want: dockerImage{
+				Name:           "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app",
+				Tag:            "v1",
+				Digest:         testDigest,
+				RepositoryName: "app",
+				HostName:       "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com",
+				Region:         "ap-northeast-1",
+			},
+		},
+		{
+			image: "nginx",
+			want: dockerImage{
+				Name:           "nginx",
+				Tag:            "latest",
+				RepositoryName: "nginx",
+			},
+		},
+		{
+			image: "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app",
+			want: dockerImage{
+				Name:           "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app",
+				Tag:            "latest",
+				RepositoryName: "app",
+				HostName:       "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com",
+				Region:         "ap-northeast-1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := (&deployCmd{}).parseDockerImage(tt.image)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestECRRegex(t *testing.T) {
+	tests := []struct {
+		hostName string
+		region   string
+	}{
+		{hostName: "123456789012.dkr.ecr.us-east-1.amazonaws.com", region: "us-east-1"},
+		{hostName: "123456789012.dkr.ecr.ap-northeast-3.amazonaws.com", region: "ap-northeast-3"},
+		{hostName: "123456789012.dkr.ecr.eu-north-1.amazonaws.com", region: "eu-north-1"},
+		{hostName: "123456789012.dkr.ecr.eu-south-2.amazonaws.com", region: "eu-south-2"},
+		{hostName: "123456789012.dkr.ecr.me-south-1.amazonaws.com", region: "me-south-1"},
+		{hostName: "123456789012.dkr.ecr.af-south-1.amazonaws.com", region: "af-south-1"},
+		{hostName: "123456789012.dkr.ecr.il-central-1.amazonaws.com", region: "il-central-1"},
+		{hostName: "123456789012.dkr.ecr.us-gov-west-1.amazonaws.com", region: "us-gov-west-1"},
+		{hostName: "docker.io", region: ""},
+		{hostName: "123456789012.dkr.ecr.local.amazonaws.com", region: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostName, func(t *testing.T) {
+			var region string
+			if matches := ECRRegex.FindStringSubmatch(tt.hostName); len(matches) > 0 {
+				region = matches[1]
+			}
+			if region != tt.region {
+				t.Errorf("region = %q, want %q", region, tt.region)
+			}
+		})
+	}
+}
+
+func TestCreateNewTaskDefinitionKeepsDigest(t *testing.T) {
+	pinned := "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/sidecar@" + testDigest
+	taskDef := &ecs.TaskDefinition{
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("app"), Image: aws.String("123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app:v1")},
+			{Name: aws.String("sidecar"), Image: aws.String(pinned)},
+		},
+	}
+
+	got, err := (&deployCmd{}).createNewTaskDefinition("release-1", taskDef)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(got.ContainerDefinitions) != 2 {
+		t.Fatalf("got %d containers, want 2", len(got.ContainerDefinitions))
+	}
+	if v := aws.StringValue(got.ContainerDefinitions[0].Image); v != "123456789012.dkr.ecr.ap-northeast-1.amazonaws.com/app:release-1" {
+		t.Errorf("image of app = %s", v)
+	}
+	if v := aws.StringValue(got.ContainerDefinitions[1].Image); v != pinned {
+		t.Errorf("digest-pinned image is re-tagged to %s", v)
+	}
+}
+
+// testDeployCmd returns a deployCmd with the defaults of the flags which validate checks
+func testDeployCmd() *deployCmd {
+	f := &deployCmd{
+		cluster:           "foo",
+		serviceName:       "bar",
+		maxPercent:        -1,
+		minHealthyPercent: -1,
+		desiredCount:      1,
+	}
+	f.images.Set("bar:v1")
+	return f
+}
+
+func TestDeployValidatePropagateTags(t *testing.T) {
+	tests := []struct {
+		value   string
+		invalid bool
+	}{
+		{value: ""},
+		{value: ecs.PropagateTagsService},
+		{value: ecs.PropagateTagsTaskDefinition},
+		{value: ecs.PropagateTagsNone},
+		{value: "service", invalid: true},
+		{value: "TASK", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			f := testDeployCmd()
+			f.propagateTags = tt.value
+			f.enableManagedTags = true
+
+			err := f.validate()
+			if tt.invalid {
+				if err == nil || err.Error() != "invalid --propagate-tags "+tt.value {
+					t.Errorf("error = %v, want invalid --propagate-tags", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestDeployValidateRegisterOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		family string
+		want   string
+	}{
+		{name: "family", family: "other"},
+		{name: "nothing to register", want: "--register-only requires --image, --task-template, --family or --container-cpu/--container-memory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := testDeployCmd()
+			f.images.Value = nil
+			f.registerOnly = true
+			f.family = tt.family
+
+			err := f.validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagDockerImage(t *testing.T) {
+	image := &ecr.Image{
+		ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testDigest), ImageTag: aws.String("v1")},
+		ImageManifest: aws.String("{}"),
+	}
+
+	tests := []struct {
+		name   string
+		res    *ecr.BatchGetImageOutput
+		putErr error
+		// want is a part of the error message. empty means no error
+		want string
+		// wantPut means the image is put with the new tag
+		wantPut bool
+	}{
+		{
+			name:    "tagged",
+			res:     &ecr.BatchGetImageOutput{Images: []*ecr.Image{image}},
+			wantPut: true,
+		},
+		{
+			name: "no images",
+			res:  &ecr.BatchGetImageOutput{},
+			want: "image tag v1 not found in repository foo",
+		},
+		{
+			name: "failures",
+			res: &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+				FailureCode:   aws.String(ecr.ImageFailureCodeImageTagDoesNotMatchDigest),
+				FailureReason: aws.String("Requested image digest does not match"),
+			}}},
+			want: "failed to get image foo:v1\n    ImageTagDoesNotMatchDigest: Requested image digest does not match",
+		},
+		{
+			name:    "already exists",
+			res:     &ecr.BatchGetImageOutput{Images: []*ecr.Image{image}},
+			putErr:  awserr.New(ecr.ErrCodeImageAlreadyExistsException, "image already exists", nil),
+			wantPut: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var put *ecr.PutImageInput
+			client := &fakeECR{
+				batchGetImage: func(in *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+					return tt.res, nil
+				},
+				putImage: func(in *ecr.PutImageInput) (*ecr.PutImageOutput, error) {
+					put = in
+					return &ecr.PutImageOutput{}, tt.putErr
+				},
+			}
+
+			digest, err := (&deployCmd{}).tagDockerImage(context.Background(), client, "foo", "v1", "release-1")
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("error = %v, want containing %q", err, tt.want)
+				}
+				if put != nil {
+					t.Errorf("image is put for an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if digest != testDigest {
+				t.Errorf("digest = %s, want %s", digest, testDigest)
+			}
+			if tt.wantPut && (put == nil || aws.StringValue(put.ImageTag) != "release-1" || aws.StringValue(put.ImageManifest) != "{}") {
+				t.Errorf("unexpected put: %v", put)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+type imageChange struct {
+	ContainerName string
+	From          string
+	To            string
+}
+
+// deployResult is collected while deploying and used for reporting
+type deployResult struct {
+	Cluster      string
+	ServiceName  string
+	DeployID     string
+	UniqueID     string
+	FromRevision int64
+	ToRevision   int64
+	TaskDefArn   string
+	Images       []*imageChange
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	RunningCount int64
+	DesiredCount int64
+	Err          error
+}
+
+func newImageChanges(from, to *ecs.TaskDefinition) []*imageChange {
+	var changes []*imageChange
+	for _, v := range to.ContainerDefinitions {
+		change := &imageChange{
+			ContainerName: aws.StringValue(v.Name),
+			To:            aws.StringValue(v.Image),
+		}
+		for _, w := range from.ContainerDefinitions {
+			if aws.StringValue(w.Name) == change.ContainerName {
+				change.From = aws.StringValue(w.Image)
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// FailureMessage returns a message for on-call to triage a failed deploy.
+// revisions are included as far as the deploy went
+func (r *deployResult) FailureMessage(images []*imageOption) string {
+	msg := fmt.Sprintf("failed to deploy. cluster: %s, serviceName: %s\n", r.Cluster, r.ServiceName)
+
+	if r.DeployID != "" {
+		msg += fmt.Sprintf("deployID: %s\n", r.DeployID)
+	}
+
+	if len(images) > 0 {
+		var tags []string
+		for _, v := range images {
+			tags = append(tags, fmt.Sprintf("%s:%s", v.RepositoryName, v.Tag))
+		}
+		msg += fmt.Sprintf("images: %s\n", strings.Join(tags, ", "))
+	}
+
+	if r.FromRevision > 0 {
+		if r.ToRevision > 0 {
+			msg += fmt.Sprintf("revision: %d -> %d\n", r.FromRevision, r.ToRevision)
+		} else {
+			msg += fmt.Sprintf("revision: %d (no new revision is registered)\n", r.FromRevision)
+		}
+	}
+
+	if r.Err != nil {
+		msg += fmt.Sprintf("error: %s\n", r.Err.Error())
+	}
+
+	return msg
+}
+
+func (r *deployResult) Outcome() string {
+	if r.Err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func (r *deployResult) Duration() time.Duration {
+	return (r.FinishedAt.Sub(r.StartedAt) / time.Second) * time.Second
+}
+
+func (r *deployResult) Markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Deploy report: %s/%s\n\n", r.Cluster, r.ServiceName)
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Outcome | %s |\n", r.Outcome())
+	fmt.Fprintf(&b, "| Cluster | %s |\n", r.Cluster)
+	fmt.Fprintf(&b, "| Service | %s |\n", r.ServiceName)
+	if r.DeployID != "" {
+		fmt.Fprintf(&b, "| Deploy ID | %s |\n", r.DeployID)
+	}
+	if r.UniqueID != "" {
+		fmt.Fprintf(&b, "| Unique ID | %s |\n", r.UniqueID)
+	}
+	if r.ToRevision > 0 {
+		fmt.Fprintf(&b, "| Revision | %d -> %d |\n", r.FromRevision, r.ToRevision)
+	} else if r.FromRevision > 0 {
+		fmt.Fprintf(&b, "| Revision | %d -> (not registered) |\n", r.FromRevision)
+	}
+	fmt.Fprintf(&b, "| Started at | %s |\n", r.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "| Duration | %s |\n", r.Duration())
+	if r.DesiredCount > 0 {
+		fmt.Fprintf(&b, "| Running / Desired | %d / %d |\n", r.RunningCount, r.DesiredCount)
+	}
+
+	if len(r.Images) > 0 {
+		fmt.Fprintf(&b, "\n## Images\n\n")
+		fmt.Fprintf(&b, "| Container | From | To |\n|---|---|---|\n")
+		for _, v := range r.Images {
+			fmt.Fprintf(&b, "| %s | `%s` | `%s` |\n", v.ContainerName, v.From, v.To)
+		}
+	}
+
+	if r.Err != nil {
+		fmt.Fprintf(&b, "\n## Error\n\n```\n%s\n```\n", r.Err.Error())
+	}
+
+	return b.String()
+}
+
+func (r *deployResult) WriteMarkdown(path string) error {
+	return ioutil.WriteFile(path, []byte(r.Markdown()), 0644)
+}
+
+type deploySummary struct {
+	Cluster      string            `json:"cluster"`
+	ServiceName  string            `json:"serviceName"`
+	DeployID     string            `json:"deployId,omitempty"`
+	FromRevision int64             `json:"fromRevision,omitempty"`
+	ToRevision   int64             `json:"toRevision,omitempty"`
+	Images       map[string]string `json:"images,omitempty"`
+	Duration     float64           `json:"durationSeconds"`
+	Status       string            `json:"status"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// WriteJSON writes a summary of the deploy in a single line of JSON.
+// images are the overrides of --image
+func (r *deployResult) WriteJSON(images []*imageOption, out io.Writer) error {
+	summary := &deploySummary{
+		Cluster:      r.Cluster,
+		ServiceName:  r.ServiceName,
+		DeployID:     r.DeployID,
+		FromRevision: r.FromRevision,
+		ToRevision:   r.ToRevision,
+		Duration:     r.Duration().Seconds(),
+		Status:       r.Outcome(),
+	}
+	if len(images) > 0 {
+		summary.Images = map[string]string{}
+		for _, v := range images {
+			summary.Images[v.RepositoryName] = v.Tag
+		}
+	}
+	if r.Err != nil {
+		summary.Error = r.Err.Error()
+	}
+
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	_, err = out.Write(b)
+	return err
+}
+
+type deployOutput struct {
+	Revision          int64  `json:"revision"`
+	TaskDefinitionArn string `json:"taskDefinitionArn"`
+	// UniqueID is the tag of images in ECR
+	UniqueID string `json:"uniqueId"`
+	DeployID string `json:"deployId"`
+}
+
+// WriteOutput writes the registered revision in JSON. path "-" means out.
+func (r *deployResult) WriteOutput(path string, out io.Writer) error {
+	b, err := json.Marshal(&deployOutput{
+		Revision:          r.ToRevision,
+		TaskDefinitionArn: r.TaskDefArn,
+		UniqueID:          r.UniqueID,
+		DeployID:          r.DeployID,
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if path == "-" {
+		_, err = out.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/spf13/cobra"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+	"github.com/SKAhack/shipctl/lib/tracing"
+)
+
+type deployStatusCmd struct {
+	cluster            string
+	serviceName        string
+	revision           int
+	backend            string
+	slackWebhookUrls   []string
+	slackUsername      string
+	slackChannel       string
+	notifyOn           string
+	color              string
+	awsOpts            awsOptions
+	historyOpts        historyOptions
+	quiet              bool
+	waitForSteadyState bool
+}
+
+func NewDeployStatusCommand(out, errOut io.Writer) *cobra.Command {
+	f := &deployStatusCmd{}
+	cmd := &cobra.Command{
+		Use:   "deploy-status [options]",
+		Short: "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			slackWebhookUrls, err := resolveSlackWebhookURLs(f.slackWebhookUrls, &f.awsOpts)
+			if err != nil {
+				return err
+			}
+			l := log.NewLogger(f.cluster, f.serviceName, slackWebhookUrls, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			l.Quiet = f.quiet
+			l.SlackUsername = f.slackUsername
+			l.SlackChannel = f.slackChannel
+			notifyOn, err := log.ParseNotifyOn(f.notifyOn)
+			if err != nil {
+				return err
+			}
+			l.NotifyOn = notifyOn
+			l.Color, err = colorEnabled(f.color, errOut)
+			if err != nil {
+				return err
+			}
+			err = f.execute(cmd, args, l)
+			if err != nil {
+				// the deploy itself failed only if the service failed to be stable
+				msg := fmt.Sprintf("failed to check the deploy status of revision %d. cluster: %s, serviceName: %s\n", f.revision, f.cluster, f.serviceName)
+				if ExitCodeOf(err) == ExitCodeDeployFailure {
+					msg = fmt.Sprintf("revision %d failed to be deployed. cluster: %s, serviceName: %s\n", f.revision, f.cluster, f.serviceName)
+				}
+				l.Status("danger", msg)
+				l.Slack("danger", msg)
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().IntVar(&f.revision, "revision", 0, "revision of ECS task definition returned by deploy --detach")
+	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
+	cmd.Flags().StringArrayVar(&f.slackWebhookUrls, "slack-webhook-url", []string{}, "slack webhook URL with an optional severity filter (URL[#all|info|success|failure]). ssm://NAME reads the URL from the SSM parameter. $SLACK_WEBHOOK_URL by default")
+	cmd.Flags().StringVar(&f.slackUsername, "slack-username", "deploy-bot", "username of slack notifications")
+	cmd.Flags().StringVar(&f.slackChannel, "slack-channel", "", "channel of slack notifications. the default channel of the webhook by default")
+	cmd.Flags().StringVar(&f.notifyOn, "notify-on", "start,success,failure", "comma-separated events to notify to slack (start, success, failure)")
+	cmd.Flags().StringVar(&f.color, "color", "auto", "color success and failure messages (auto, always or never). auto colors them if stderr is a terminal")
+	f.awsOpts.addFlags(cmd.Flags())
+	f.historyOpts.addFlags(cmd.Flags())
+	cmd.Flags().BoolVarP(&f.quiet, "quiet", "q", false, "suppress periodic progress messages")
+	cmd.Flags().BoolVar(&f.waitForSteadyState, "wait-for-steady-state", true, "wait until the previous deployment is drained and the rollout is completed. false only waits for the running count to reach the desired count")
+
+	return cmd
+}
+
+func (f *deployStatusCmd) execute(_ *cobra.Command, args []string, l *log.Logger) (err error) {
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "deploy-status")
+	defer func() { tracing.End(span, err) }()
+
+	if f.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return errors.New("--service-name is required")
+	}
+
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+	f.cluster, f.serviceName = cluster, serviceName
+	span.SetAttributes(tracing.Service(f.cluster, f.serviceName)...)
+
+	if f.revision <= 0 {
+		return errors.New("--revision is required")
+	}
+
+	region := f.awsOpts.resolveRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+	l.ConsoleURL = ecsConsoleURL(region, f.cluster, f.serviceName)
+
+	sess, err := newAWSSession(&f.awsOpts)
+	if err != nil {
+		return err
+	}
+
+	err = checkCredentials(ctx, sess, f.awsOpts.config(region), l)
+	if err != nil {
+		return err
+	}
+
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName, &f.awsOpts, &f.historyOpts)
+	if err != nil {
+		return err
+	}
+
+	states, err := historyManager.Pull()
+	if err != nil {
+		return err
+	}
+
+	var state *deployState
+	for i := len(states) - 1; i >= 0; i-- {
+		if states[i].Revision == f.revision {
+			state = states[i]
+			break
+		}
+	}
+	if state == nil {
+		return errors.New(fmt.Sprintf("revision %d is not found in history", f.revision))
+	}
+
+	if state.Status == deployStatus_DEPLOYED || state.Status == deployStatus_CANARY {
+		l.Log(fmt.Sprintf("revision %d is already %s\n", f.revision, state.Status))
+		return nil
+	}
+
+	if state.Status == deployStatus_CANCELLED {
+		return errors.New(fmt.Sprintf("revision %d is cancelled", f.revision))
+	}
+
+	l.Debug(fmt.Sprintf("describe service %s\n", f.serviceName))
+	service, err := describeService(ctx, client, f.cluster, f.serviceName, region, l)
+	if err != nil {
+		return err
+	}
+
+	taskDef, err := libecs.DescribeTaskDefinition(ctx, client, *service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+
+	if int(*taskDef.Revision) != f.revision {
+		return errors.New(fmt.Sprintf("service is running revision %d, not %d", *taskDef.Revision, f.revision))
+	}
+
+	l.Log(fmt.Sprintf("service updating\n"))
+
+	l.Debug(fmt.Sprintf("wait for service %s to be stable\n", f.serviceName))
+	_, waitSpan := tracing.Start(ctx, "wait", tracing.Service(f.cluster, f.serviceName)...)
+	waitSpan.SetAttributes(tracing.Revision(*taskDef.Revision))
+	err = libecs.WaitUpdateService(ctx, client, f.cluster, f.serviceName, f.waitForSteadyState, l)
+	tracing.End(waitSpan, err)
+	if err != nil {
+		return newDeployFailure(err)
+	}
+
+	// a canary keeps running until deploy --promote
+	status := deployStatus_DEPLOYED
+	if state.DesiredCount > 0 {
+		status = deployStatus_CANARY
+	}
+
+	err = historyManager.UpdateState(f.revision, status)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("successfully updated\n")
+	l.Status("good", msg)
+	l.Slack("good", msg)
+
+	return nil
+}
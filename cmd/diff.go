@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/spf13/cobra"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+type diffCmd struct {
+	cluster     string
+	serviceName string
+	revision    int
+	images      imageOptions
+	imagesFile  string
+	awsOpts     awsOptions
+}
+
+func NewDiffCommand(out, errOut io.Writer) *cobra.Command {
+	f := &diffCmd{}
+	cmd := &cobra.Command{
+		Use:   "diff [options]",
+		Short: "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.NewLogger(f.cluster, f.serviceName, nil, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			err := f.execute(cmd, args, l)
+			if err != nil {
+				l.Log(fmt.Sprintf("error: %s\n", err.Error()))
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().IntVar(&f.revision, "revision", 0, "revision of ECS task definition")
+	cmd.Flags().Var(&f.images, "image", "base image of ECR image")
+	cmd.Flags().StringVar(&f.imagesFile, "images-file", "", "path to a YAML or JSON file mapping repository names to tags. --image takes precedence")
+	f.awsOpts.addFlags(cmd.Flags())
+
+	return cmd
+}
+
+func (f *diffCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+	ctx := context.Background()
+
+	if f.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return errors.New("--service-name is required")
+	}
+
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+	f.cluster, f.serviceName = cluster, serviceName
+
+	if f.imagesFile != "" {
+		err := f.images.LoadFile(f.imagesFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(f.images.Value) == 0 {
+		return errors.New("--image is required")
+	}
+
+	region := f.awsOpts.resolveRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+
+	sess, err := newAWSSession(&f.awsOpts)
+	if err != nil {
+		return err
+	}
+
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	service, err := describeService(ctx, client, f.cluster, f.serviceName, region, l)
+	if err != nil {
+		return err
+	}
+
+	taskDefArn, err := libecs.SpecifyRevision(f.revision, *service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+
+	taskDef, err := libecs.DescribeTaskDefinition(ctx, client, taskDefArn)
+	if err != nil {
+		return err
+	}
+
+	// computes the task definition in the same way as deploy, without tagging images nor registering
+	deploy := &deployCmd{images: f.images}
+	newTaskDef, err := deploy.createNewTaskDefinition("NEW", taskDef)
+	if err != nil {
+		return err
+	}
+
+	newContainers := map[string]*ecs.ContainerDefinition{}
+	for _, v := range newTaskDef.ContainerDefinitions {
+		img, err := deploy.parseDockerImage(*v.Image)
+		if err != nil {
+			return err
+		}
+
+		if img.Digest == "" {
+			opt := f.images.Get(img.RepositoryName)
+			if opt == nil {
+				return errors.New(fmt.Sprintf("can not found image option %s", img.RepositoryName))
+			}
+			// deploy tags the image of --image with a unique tag, so the same image is shown here
+			c := *v // shallow copy
+			c.Image = aws.String(fmt.Sprintf("%s:%s", img.Name, opt.Tag))
+			v = &c
+		}
+		newContainers[*v.Name] = v
+	}
+
+	l.Result(fmt.Sprintf("task definition: %s\n", *taskDef.TaskDefinitionArn))
+
+	changed := false
+	for _, v := range taskDef.ContainerDefinitions {
+		nv, ok := newContainers[*v.Name]
+		if !ok {
+			changed = true
+			l.Result(fmt.Sprintf("container %s\n", *v.Name))
+			l.Result("  removed (the image is not hosted on ECR)\n")
+			continue
+		}
+
+		fields, err := diffContainerDefinitions(v, nv)
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		changed = true
+		l.Result(fmt.Sprintf("container %s\n", *v.Name))
+		for _, field := range fields {
+			l.Result(fmt.Sprintf("  %s\n", field))
+		}
+	}
+
+	if !changed {
+		l.Result("no changes\n")
+	}
+
+	return nil
+}
+
+// diffContainerDefinitions returns the fields which differ between the container definitions,
+// in the form "name: old -> new"
+func diffContainerDefinitions(a, b *ecs.ContainerDefinition) ([]string, error) {
+	am, err := toJSONMap(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bm, err := toJSONMap(b)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for k := range am {
+		keys[k] = true
+	}
+	for k := range bm {
+		keys[k] = true
+	}
+
+	var names []string
+	for k := range keys {
+		if !reflect.DeepEqual(am[k], bm[k]) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var fields []string
+	for _, k := range names {
+		av, err := json.Marshal(am[k])
+		if err != nil {
+			return nil, err
+		}
+		bv, err := json.Marshal(bm[k])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s -> %s", k, av, bv))
+	}
+
+	return fields, nil
+}
+
+func toJSONMap(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]interface{}{}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+)
+
+// fakeECS implements libecs.ECSAPI by the functions set by a test.
+// methods which are not overridden panic with the nil embedded interface
+type fakeECS struct {
+	libecs.ECSAPI
+
+	describeServices func(*ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error)
+	updateService    func(*ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error)
+	describeTasks    func(*ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error)
+}
+
+func (c *fakeECS) DescribeServicesWithContext(_ aws.Context, in *ecs.DescribeServicesInput, _ ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	return c.describeServices(in)
+}
+
+func (c *fakeECS) UpdateServiceWithContext(_ aws.Context, in *ecs.UpdateServiceInput, _ ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	return c.updateService(in)
+}
+
+func (c *fakeECS) DescribeTasksWithContext(_ aws.Context, in *ecs.DescribeTasksInput, _ ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	return c.describeTasks(in)
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+type historyCmd struct {
+	cluster     string
+	serviceName string
+	backend     string
+	since       string
+	awsOpts     awsOptions
+}
+
+func NewHistoryCommand(out, errOut io.Writer) *cobra.Command {
+	f := &historyCmd{}
+	cmd := &cobra.Command{
+		Use:   "history [options]",
+		Short: "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.NewLogger(f.cluster, f.serviceName, nil, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			err := f.execute(cmd, args, l)
+			if err != nil {
+				l.Log(fmt.Sprintf("error: %s\n", err.Error()))
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of state manager")
+	cmd.Flags().StringVar(&f.since, "since", "", "print only states within the window (e.g. 24h, 2023-01-01)")
+	f.awsOpts.addFlags(cmd.Flags())
+
+	return cmd
+}
+
+func (f *historyCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+	if f.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return errors.New("--service-name is required")
+	}
+
+	var since time.Time
+	if f.since != "" {
+		v, err := parseSince(f.since, time.Now())
+		if err != nil {
+			return err
+		}
+		since = v
+	}
+
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+	f.cluster, f.serviceName = cluster, serviceName
+
+	// the history is only read, so encryption options are not needed
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName, &f.awsOpts, &historyOptions{})
+	if err != nil {
+		return err
+	}
+
+	states, err := historyManager.Pull()
+	if err != nil {
+		return err
+	}
+
+	printHistory(states, since, l)
+
+	return nil
+}
+
+// printHistory prints states newer than since, newest first. the latest state is marked with *.
+// states without a timestamp are always printed
+func printHistory(states []*deployState, since time.Time, l *log.Logger) {
+	if len(states) == 0 {
+		l.Log("no history\n")
+		return
+	}
+
+	for i := len(states) - 1; i >= 0; i-- {
+		v := states[i]
+		mark := " "
+		if i == len(states)-1 {
+			mark = "*"
+		}
+		timestamp := "unknown time"
+		if v.Timestamp != nil {
+			if v.Timestamp.Before(since) {
+				continue
+			}
+			timestamp = v.Timestamp.Local().Format("2006-01-02 15:04:05")
+		}
+		l.Result(fmt.Sprintf("%s %5d  %-19s  %-9s  %-8s  %s\n", mark, v.Revision, timestamp, v.Status, v.GetKind(), v.Cause))
+	}
+}
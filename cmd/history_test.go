@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+func TestPrintHistorySince(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		v := now.Add(-d)
+		return &v
+	}
+
+	states := []*deployState{
+		{Revision: 9, Status: deployStatus_DEPLOYED, Cause: "deploy: 8 -> 9"},
+		{Revision: 10, Status: deployStatus_DEPLOYED, Cause: "deploy: 9 -> 10", Timestamp: at(48 * time.Hour)},
+		{Revision: 11, Status: deployStatus_DEPLOYED, Cause: "deploy: 10 -> 11", Timestamp: at(2 * time.Hour)},
+		{Revision: 10, Status: deployStatus_DEPLOYED, Cause: "rollback: 11 -> 10", Kind: deployKind_ROLLBACK, Timestamp: at(time.Hour)},
+	}
+
+	tests := []struct {
+		name  string
+		since time.Time
+		// want is the causes of the printed states in order
+		want []string
+	}{
+		{name: "without since", want: []string{"rollback: 11 -> 10", "deploy: 10 -> 11", "deploy: 9 -> 10", "deploy: 8 -> 9"}},
+		// states without a timestamp are always printed
+		{name: "24h", since: now.Add(-24 * time.Hour), want: []string{"rollback: 11 -> 10", "deploy: 10 -> 11", "deploy: 8 -> 9"}},
+		{name: "30m", since: now.Add(-30 * time.Minute), want: []string{"deploy: 8 -> 9"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			l := log.NewLogger("foo", "bar", nil, &out, ioutil.Discard)
+			printHistory(states, tt.since, l)
+
+			lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("printed %d states, want %d:\n%s", len(lines), len(tt.want), out.String())
+			}
+			for i, v := range tt.want {
+				if !strings.HasSuffix(lines[i], v) {
+					t.Errorf("line %d = %q, want the state of %s", i, lines[i], v)
+				}
+			}
+			if strings.Contains(out.String(), "rollback: 11 -> 10") && !strings.Contains(lines[0], "ROLLBACK") {
+				t.Errorf("kind of the rollback is not printed: %q", lines[0])
+			}
+		})
+	}
+}
@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/pflag"
+
+	"github.com/SKAhack/shipctl/lib/awsutil"
 )
 
 const defaultHistoryLimit int = 5
@@ -18,54 +22,179 @@ type deployStatus int
 const (
 	deployStatus_UNKNOWN deployStatus = iota
 	deployStatus_DEPLOYED
+	deployStatus_PENDING
+	deployStatus_CANARY
+	deployStatus_CANCELLED
+)
+
+func (s deployStatus) String() string {
+	switch s {
+	case deployStatus_DEPLOYED:
+		return "DEPLOYED"
+	case deployStatus_PENDING:
+		return "PENDING"
+	case deployStatus_CANARY:
+		return "CANARY"
+	case deployStatus_CANCELLED:
+		return "CANCELLED"
+	}
+	return "UNKNOWN"
+}
+
+type deployKind string
+
+const (
+	deployKind_DEPLOY   deployKind = "DEPLOY"
+	deployKind_ROLLBACK deployKind = "ROLLBACK"
 )
 
 type deployState struct {
 	Revision int          `json:"revision"`
 	Status   deployStatus `json:"status"`
 	Cause    string       `json:"cause"`
+	// DesiredCount is the desired count to restore when a canary is promoted
+	DesiredCount int64 `json:"desiredCount,omitempty"`
+	// DeployID correlates the state with the deploy of --deploy-id
+	DeployID string `json:"deployId,omitempty"`
+	// Digests are the digests of images tagged by the deploy, by repository names
+	Digests map[string]string `json:"digests,omitempty"`
+	// Kind is empty in states pushed before it is introduced. use GetKind
+	Kind deployKind `json:"kind,omitempty"`
+	// Timestamp is nil in states pushed before it is introduced
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// GetKind returns the kind of the state. it is inferred from the cause for old states
+func (s *deployState) GetKind() deployKind {
+	if s.Kind != "" {
+		return s.Kind
+	}
+	if strings.HasPrefix(s.Cause, "rollback:") || strings.HasPrefix(s.Cause, "auto-rollback:") || strings.HasPrefix(s.Cause, "cancel:") {
+		return deployKind_ROLLBACK
+	}
+	return deployKind_DEPLOY
+}
+
+func stateTimestamp() *time.Time {
+	t := time.Now().UTC()
+	return &t
+}
+
+// parseSince parses a duration (24h) or a date (2006-01-02 or RFC3339) to the start of a window
+func parseSince(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		if d < 0 {
+			return time.Time{}, errors.New(fmt.Sprintf("invalid --since: %s. must be a positive duration", v))
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("invalid --since: %s. must be a duration (e.g. 24h) or a date (e.g. 2023-01-01)", v))
 }
 
 type historyManager interface {
-	PushState(int, string) error
+	PushState(int, deployStatus, string) error
+	PushRollbackState(int, string) error
+	PushCanaryState(int, int64, string) error
+	UpdateState(int, deployStatus) error
+	SetDigests(int, map[string]string) error
 	Pull() ([]*deployState, error)
 }
 
-func NewHistoryManager(backend, clusterName, serviceName string) (historyManager, error) {
+// historyOptions holds flags for the history manager common to the commands
+type historyOptions struct {
+	encrypt  bool
+	kmsKeyID string
+	// deployID is recorded in pushed states. it is set by deploy, not by a flag
+	deployID string
+}
+
+func (o *historyOptions) addFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&o.encrypt, "encrypt-state", false, "store the history as a SecureString parameter")
+	flags.StringVar(&o.kmsKeyID, "kms-key-id", "", "KMS key to encrypt the history with --encrypt-state. the AWS managed key by default")
+}
+
+func NewHistoryManager(backend, clusterName, serviceName string, awsOpts *awsOptions, historyOpts *historyOptions) (historyManager, error) {
+	if historyOpts.kmsKeyID != "" && !historyOpts.encrypt {
+		return nil, errors.New("--kms-key-id requires --encrypt-state")
+	}
+
+	var m *ssmHistoryManager
+	var err error
 	if backend == "SSM" {
-		return NewSSMHistoryManager(clusterName, serviceName)
+		m, err = NewSSMHistoryManager(clusterName, serviceName, awsOpts)
+	} else {
+		m, err = NewSSMHistoryManager(clusterName, serviceName, awsOpts)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return NewSSMHistoryManager(clusterName, serviceName)
+
+	m.Encrypt = historyOpts.encrypt
+	m.KmsKeyID = historyOpts.kmsKeyID
+	m.DeployID = historyOpts.deployID
+
+	return m, nil
+}
+
+// SSMAPI is the subset of the SSM client used by ssmHistoryManager
+type SSMAPI interface {
+	GetParameter(*ssm.GetParameterInput) (*ssm.GetParameterOutput, error)
+	PutParameter(*ssm.PutParameterInput) (*ssm.PutParameterOutput, error)
+	DescribeParameters(*ssm.DescribeParametersInput) (*ssm.DescribeParametersOutput, error)
 }
 
 type ssmHistoryManager struct {
-	Client       *ssm.SSM
+	Client       SSMAPI
 	ClusterName  string
 	ServiceName  string
 	HistoryLimit int
+	// Encrypt stores the history as a SecureString with KmsKeyID
+	Encrypt  bool
+	KmsKeyID string
+	// DeployID is recorded in the states pushed by this manager
+	DeployID string
+
+	// states caches the pulled history so a single invocation reads SSM once.
+	states []*deployState
+}
+
+func NewSSMHistoryManager(clusterName, serviceName string, awsOpts *awsOptions) (*ssmHistoryManager, error) {
+	client, err := newSSMClient(awsOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSSMHistoryManagerWithClient(client, clusterName, serviceName), nil
 }
 
-func NewSSMHistoryManager(clusterName, serviceName string) (*ssmHistoryManager, error) {
-	sess, err := session.NewSession()
+func newSSMClient(awsOpts *awsOptions) (*ssm.SSM, error) {
+	sess, err := newAWSSession(awsOpts)
 	if err != nil {
 		return nil, err
 	}
 
-	region := getAWSRegion()
+	region := awsOpts.resolveRegion()
 	if region == "" {
-		return nil, errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
+		return nil, errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
 	}
 
-	client := ssm.New(sess, &aws.Config{
-		Region: aws.String(region),
-	})
+	return ssm.New(sess, awsOpts.config(region)), nil
+}
 
+// NewSSMHistoryManagerWithClient returns a history manager of the service which stores the history with client
+func NewSSMHistoryManagerWithClient(client SSMAPI, clusterName, serviceName string) *ssmHistoryManager {
 	return &ssmHistoryManager{
 		Client:       client,
 		ClusterName:  clusterName,
 		ServiceName:  serviceName,
 		HistoryLimit: defaultHistoryLimit,
-	}, nil
+	}
 }
 
 func (s *ssmHistoryManager) Push(v string) error {
@@ -75,24 +204,112 @@ func (s *ssmHistoryManager) Push(v string) error {
 		Value:     aws.String(v),
 		Overwrite: aws.Bool(true),
 	}
+	if s.Encrypt {
+		p.Type = aws.String("SecureString")
+		if s.KmsKeyID != "" {
+			p.KeyId = aws.String(s.KmsKeyID)
+		}
+	}
 	_, err := s.Client.PutParameter(p)
 	if err != nil {
-		return err
+		return awsutil.WrapError(err)
 	}
 	return nil
 }
 
-func (s *ssmHistoryManager) PushState(revision int, cause string) error {
+func (s *ssmHistoryManager) PushState(revision int, status deployStatus, cause string) error {
+	state, err := s.Pull()
+	if err != nil {
+		return err
+	}
+	state = append(state, &deployState{
+		Revision:  revision,
+		Status:    status,
+		Cause:     cause,
+		DeployID:  s.DeployID,
+		Kind:      deployKind_DEPLOY,
+		Timestamp: stateTimestamp(),
+	})
+
+	return s.save(state)
+}
+
+// PushRollbackState pushes a DEPLOYED state of a rollback to the existing revision
+func (s *ssmHistoryManager) PushRollbackState(revision int, cause string) error {
 	state, err := s.Pull()
 	if err != nil {
 		return err
 	}
 	state = append(state, &deployState{
-		Revision: revision,
-		Status:   deployStatus_DEPLOYED,
-		Cause:    cause,
+		Revision:  revision,
+		Status:    deployStatus_DEPLOYED,
+		Cause:     cause,
+		DeployID:  s.DeployID,
+		Kind:      deployKind_ROLLBACK,
+		Timestamp: stateTimestamp(),
 	})
 
+	return s.save(state)
+}
+
+// PushCanaryState pushes a PENDING state of a canary with the desired count to restore
+func (s *ssmHistoryManager) PushCanaryState(revision int, desiredCount int64, cause string) error {
+	state, err := s.Pull()
+	if err != nil {
+		return err
+	}
+	state = append(state, &deployState{
+		Revision:     revision,
+		Status:       deployStatus_PENDING,
+		Cause:        cause,
+		DesiredCount: desiredCount,
+		DeployID:     s.DeployID,
+		Kind:         deployKind_DEPLOY,
+		Timestamp:    stateTimestamp(),
+	})
+
+	return s.save(state)
+}
+
+// UpdateState changes the status of the latest state of the given revision.
+func (s *ssmHistoryManager) UpdateState(revision int, status deployStatus) error {
+	state, err := s.Pull()
+	if err != nil {
+		return err
+	}
+
+	for i := len(state) - 1; i >= 0; i-- {
+		if state[i].Revision == revision {
+			v := *state[i] // shallow copy
+			v.Status = status
+			state[i] = &v
+			return s.save(state)
+		}
+	}
+
+	return errors.New(fmt.Sprintf("revision %d is not found in history", revision))
+}
+
+// SetDigests sets the digests of images to the latest state of the given revision.
+func (s *ssmHistoryManager) SetDigests(revision int, digests map[string]string) error {
+	state, err := s.Pull()
+	if err != nil {
+		return err
+	}
+
+	for i := len(state) - 1; i >= 0; i-- {
+		if state[i].Revision == revision {
+			v := *state[i] // shallow copy
+			v.Digests = digests
+			state[i] = &v
+			return s.save(state)
+		}
+	}
+
+	return errors.New(fmt.Sprintf("revision %d is not found in history", revision))
+}
+
+func (s *ssmHistoryManager) save(state []*deployState) error {
 	from := 0
 	if len(state) > s.HistoryLimit {
 		from = len(state) - s.HistoryLimit
@@ -109,51 +326,57 @@ func (s *ssmHistoryManager) PushState(revision int, cause string) error {
 		return err
 	}
 
+	s.states = state
+
 	return nil
 }
 
 func (s *ssmHistoryManager) Pull() ([]*deployState, error) {
-	filter := &ssm.ParametersFilter{
-		Key: aws.String("Name"),
-		Values: []*string{
-			aws.String(s.getName()),
-		},
-	}
-	filters := []*ssm.ParametersFilter{filter}
-
-	var key *string
-	{
-		p := &ssm.DescribeParametersInput{
-			Filters:    filters,
-			MaxResults: aws.Int64(1),
-		}
-		re, err := s.Client.DescribeParameters(p)
+	if s.states == nil {
+		states, err := s.pull()
 		if err != nil {
 			return nil, err
 		}
-		if len(re.Parameters) == 0 {
-			return []*deployState{}, nil
-		}
+		s.states = states
+	}
 
-		key = re.Parameters[0].Name
+	// return a copy so callers can't modify the cache by appending
+	states := make([]*deployState, len(s.states))
+	copy(states, s.states)
+	return states, nil
+}
+
+// pull gets the parameter by the exact name, since the Name filter of DescribeParameters
+// may also match other services whose names start with the same name
+func (s *ssmHistoryManager) pull() ([]*deployState, error) {
+	// decryption is always requested, so that an encrypted history can be read without --encrypt-state
+	p := &ssm.GetParameterInput{
+		Name:           aws.String(s.getName()),
+		WithDecryption: aws.Bool(true),
+	}
+	re, err := s.Client.GetParameter(p)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return []*deployState{}, nil
 	}
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+	v := re.Parameter.Value
 
-	var v *string
-	{
-		p := &ssm.GetParametersInput{
-			Names:          []*string{key},
-			WithDecryption: aws.Bool(false),
-		}
-		re, err := s.Client.GetParameters(p)
-		if err != nil {
-			return nil, err
+	// keep an encrypted history encrypted with the same key even without --encrypt-state
+	if aws.StringValue(re.Parameter.Type) == ssm.ParameterTypeSecureString {
+		s.Encrypt = true
+		if s.KmsKeyID == "" {
+			keyID, err := s.keyID()
+			if err != nil {
+				return nil, err
+			}
+			s.KmsKeyID = keyID
 		}
-
-		v = re.Parameters[0].Value
 	}
 
 	var states []*deployState
-	err := json.NewDecoder(strings.NewReader(*v)).Decode(&states)
+	err = json.NewDecoder(strings.NewReader(*v)).Decode(&states)
 	if err != nil {
 		return nil, err
 	}
@@ -161,6 +384,28 @@ func (s *ssmHistoryManager) Pull() ([]*deployState, error) {
 	return states, nil
 }
 
+// keyID returns the KMS key of the parameter, which GetParameter does not return
+func (s *ssmHistoryManager) keyID() (string, error) {
+	p := &ssm.DescribeParametersInput{
+		ParameterFilters: []*ssm.ParameterStringFilter{
+			{
+				Key:    aws.String("Name"),
+				Option: aws.String("Equals"),
+				Values: []*string{aws.String(s.getName())},
+			},
+		},
+	}
+	re, err := s.Client.DescribeParameters(p)
+	if err != nil {
+		return "", awsutil.WrapError(err)
+	}
+	if len(re.Parameters) == 0 {
+		return "", errors.New(fmt.Sprintf("parameter %s is not found", s.getName()))
+	}
+
+	return aws.StringValue(re.Parameters[0].KeyId), nil
+}
+
 func (s *ssmHistoryManager) getName() string {
 	return fmt.Sprintf("deploy-state.%s.%s", s.ClusterName, s.ServiceName)
 }
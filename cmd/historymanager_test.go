@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// fakeSSM keeps parameters in memory
+type fakeSSM struct {
+	parameters map[string]*ssm.Parameter
+	// keyIDs are the KMS keys of SecureString parameters
+	keyIDs map[string]*string
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM{parameters: map[string]*ssm.Parameter{}, keyIDs: map[string]*string{}}
+}
+
+func (c *fakeSSM) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	p, ok := c.parameters[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter is not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: p}, nil
+}
+
+func (c *fakeSSM) PutParameter(in *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	c.parameters[aws.StringValue(in.Name)] = &ssm.Parameter{
+		Name:  in.Name,
+		Type:  in.Type,
+		Value: in.Value,
+	}
+	keyID := in.KeyId
+	if aws.StringValue(in.Type) == ssm.ParameterTypeSecureString && keyID == nil {
+		keyID = aws.String("alias/aws/ssm")
+	}
+	c.keyIDs[aws.StringValue(in.Name)] = keyID
+	return &ssm.PutParameterOutput{}, nil
+}
+
+// DescribeParameters supports only the Name filter with the Equals option
+func (c *fakeSSM) DescribeParameters(in *ssm.DescribeParametersInput) (*ssm.DescribeParametersOutput, error) {
+	var parameters []*ssm.ParameterMetadata
+	for _, f := range in.ParameterFilters {
+		if aws.StringValue(f.Key) != "Name" || aws.StringValue(f.Option) != "Equals" {
+			return nil, awserr.New(ssm.ErrCodeInvalidFilterKey, "unsupported filter", nil)
+		}
+		for _, name := range aws.StringValueSlice(f.Values) {
+			if p, ok := c.parameters[name]; ok {
+				parameters = append(parameters, &ssm.ParameterMetadata{Name: p.Name, Type: p.Type, KeyId: c.keyIDs[name]})
+			}
+		}
+	}
+	return &ssm.DescribeParametersOutput{Parameters: parameters}, nil
+}
+
+// storedRevisions returns the revisions of the history stored in the parameter
+func (c *fakeSSM) storedRevisions(t *testing.T, name string) []int {
+	p, ok := c.parameters[name]
+	if !ok {
+		t.Fatalf("parameter %s is not stored", name)
+	}
+
+	var states []*deployState
+	err := json.Unmarshal([]byte(aws.StringValue(p.Value)), &states)
+	if err != nil {
+		t.Fatalf("failed to decode the history: %s", err)
+	}
+
+	revisions := []int{}
+	for _, v := range states {
+		revisions = append(revisions, v.Revision)
+	}
+	return revisions
+}
+
+func TestSSMHistoryManagerTrimming(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		// existing is the number of states before a state of the next revision is pushed
+		existing int
+		want     []int
+	}{
+		{name: "limit 0", limit: 0, existing: 2, want: []int{}},
+		{name: "limit 1", limit: 1, existing: 2, want: []int{3}},
+		{name: "under the limit", limit: 5, existing: 2, want: []int{1, 2, 3}},
+		{name: "at the limit", limit: 3, existing: 2, want: []int{1, 2, 3}},
+		{name: "over the limit", limit: 3, existing: 4, want: []int{3, 4, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeSSM()
+			m := NewSSMHistoryManagerWithClient(client, "foo", "bar")
+
+			var states []*deployState
+			for i := 1; i <= tt.existing; i++ {
+				states = append(states, &deployState{Revision: i, Status: deployStatus_DEPLOYED})
+			}
+			b, err := json.Marshal(states)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.parameters[m.getName()] = &ssm.Parameter{Type: aws.String("String"), Value: aws.String(string(b))}
+
+			m.HistoryLimit = tt.limit
+			err = m.PushState(tt.existing+1, deployStatus_PENDING, "deploy")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if got := client.storedRevisions(t, m.getName()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stored revisions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSMHistoryManagerRoundTrip(t *testing.T) {
+	client := newFakeSSM()
+
+	m := NewSSMHistoryManagerWithClient(client, "foo", "bar")
+	m.DeployID = "release-1"
+	err := m.PushState(10, deployStatus_PENDING, "deploy: 9 -> 10")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = m.UpdateState(10, deployStatus_DEPLOYED)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// a new manager has no cache, so it reads the pushed history from the client
+	states, err := NewSSMHistoryManagerWithClient(client, "foo", "bar").Pull()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(states) != 1 {
+		t.Fatalf("got %d states, want 1", len(states))
+	}
+	got := states[0]
+	if got.Revision != 10 || got.Status != deployStatus_DEPLOYED || got.Cause != "deploy: 9 -> 10" || got.DeployID != "release-1" || got.GetKind() != deployKind_DEPLOY {
+		t.Errorf("unexpected state: %+v", got)
+	}
+	if got.Timestamp == nil {
+		t.Errorf("timestamp is not recorded")
+	}
+
+	if _, ok := client.parameters["deploy-state.foo.bar"]; !ok {
+		t.Errorf("history is not stored in deploy-state.foo.bar")
+	}
+}
+
+func TestSSMHistoryManagerPullWithoutHistory(t *testing.T) {
+	states, err := NewSSMHistoryManagerWithClient(newFakeSSM(), "foo", "bar").Pull()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(states) != 0 {
+		t.Errorf("got %d states, want 0", len(states))
+	}
+}
+
+func TestSSMHistoryManagerKeepsKmsKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		kmsKeyID string
+		want     string
+	}{
+		{name: "custom key", kmsKeyID: "alias/deploy-state", want: "alias/deploy-state"},
+		{name: "AWS managed key", kmsKeyID: "", want: "alias/aws/ssm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeSSM()
+
+			m := NewSSMHistoryManagerWithClient(client, "foo", "bar")
+			m.Encrypt = true
+			m.KmsKeyID = tt.kmsKeyID
+			err := m.PushState(10, deployStatus_DEPLOYED, "deploy: 9 -> 10")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// a later command without --encrypt-state nor --kms-key-id
+			m = NewSSMHistoryManagerWithClient(client, "foo", "bar")
+			err = m.PushState(11, deployStatus_DEPLOYED, "deploy: 10 -> 11")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			name := m.getName()
+			if v := aws.StringValue(client.parameters[name].Type); v != ssm.ParameterTypeSecureString {
+				t.Errorf("type = %s, want SecureString", v)
+			}
+			if v := aws.StringValue(client.keyIDs[name]); v != tt.want {
+				t.Errorf("key = %s, want %s", v, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/spf13/cobra"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+type listRevisionsCmd struct {
+	cluster     string
+	serviceName string
+	taskDefName string
+	limit       int
+	json        bool
+	awsOpts     awsOptions
+}
+
+type revisionInfo struct {
+	Revision     int        `json:"revision"`
+	Status       string     `json:"status"`
+	RegisteredAt *time.Time `json:"registeredAt,omitempty"`
+	Arn          string     `json:"arn"`
+	Current      bool       `json:"current"`
+}
+
+func NewListRevisionsCommand(out, errOut io.Writer) *cobra.Command {
+	f := &listRevisionsCmd{}
+	cmd := &cobra.Command{
+		Use:   "list-revisions [options]",
+		Short: "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.NewLogger(f.cluster, f.serviceName, nil, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			err := f.execute(cmd, args, l)
+			if err != nil {
+				l.Log(fmt.Sprintf("error: %s\n", err.Error()))
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS cluster name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS service name")
+	cmd.Flags().StringVar(&f.taskDefName, "taskdef-name", "", "ECS task definition family name")
+	cmd.Flags().IntVar(&f.limit, "limit", 20, "max number of revisions to list, newest first")
+	cmd.Flags().BoolVar(&f.json, "json", false, "output in JSON")
+	f.awsOpts.addFlags(cmd.Flags())
+
+	return cmd
+}
+
+func (f *listRevisionsCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+	ctx := context.Background()
+
+	if f.taskDefName == "" && (f.cluster == "" || f.serviceName == "") {
+		return errors.New("--cluster and --service-name, or --taskdef-name is required")
+	}
+
+	if f.limit <= 0 {
+		return errors.New("--limit must be positive")
+	}
+
+	region := f.awsOpts.resolveRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+
+	sess, err := newAWSSession(&f.awsOpts)
+	if err != nil {
+		return err
+	}
+
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	family := f.taskDefName
+	currentArn := ""
+	if f.serviceName != "" && f.cluster != "" {
+		service, err := describeService(ctx, client, f.cluster, f.serviceName, region, l)
+		if err != nil {
+			return err
+		}
+		currentArn = *service.TaskDefinition
+
+		if family == "" {
+			re, _ := regexp.Compile(`:task-definition/(.+):[1-9][0-9]*$`)
+			matches := re.FindStringSubmatch(currentArn)
+			if len(matches) == 0 {
+				return errors.New(fmt.Sprintf("family is not found in %s", currentArn))
+			}
+			family = matches[1]
+		}
+	}
+
+	var revisions []*revisionInfo
+	for _, status := range []string{ecs.TaskDefinitionStatusActive, ecs.TaskDefinitionStatusInactive} {
+		arns, err := libecs.ListTaskDefinitions(ctx, client, family, status)
+		if err != nil {
+			return err
+		}
+		for _, arn := range arns {
+			revision, err := libecs.RevisionOf(arn)
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, &revisionInfo{
+				Revision: revision,
+				Status:   status,
+				Arn:      arn,
+				Current:  arn == currentArn,
+			})
+		}
+	}
+
+	if len(revisions) == 0 {
+		return errors.New(fmt.Sprintf("no revisions are found in family %s", family))
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+	if len(revisions) > f.limit {
+		revisions = revisions[:f.limit]
+	}
+
+	for _, v := range revisions {
+		taskDef, err := libecs.DescribeTaskDefinition(ctx, client, v.Arn)
+		if err != nil {
+			return err
+		}
+		v.RegisteredAt = taskDef.RegisteredAt
+	}
+
+	if f.json {
+		b, err := json.MarshalIndent(revisions, "", "  ")
+		if err != nil {
+			return err
+		}
+		l.Result(string(b) + "\n")
+		return nil
+	}
+
+	for _, v := range revisions {
+		mark := " "
+		if v.Current {
+			mark = "*"
+		}
+		registeredAt := "-"
+		if v.RegisteredAt != nil {
+			registeredAt = v.RegisteredAt.Format(time.RFC3339)
+		}
+		l.Result(fmt.Sprintf("%s %5d  %-8s  %s\n", mark, v.Revision, v.Status, registeredAt))
+	}
+
+	return nil
+}
@@ -1,19 +1,26 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/spf13/cobra"
 
 	libecs "github.com/SKAhack/shipctl/lib/ecs"
@@ -21,12 +28,37 @@ import (
 )
 
 type oneshotCmd struct {
-	cluster     string
-	taskDefName string
-	serviceName string
-	command     []string
-	revision    int
-	shellExec   bool
+	cluster              string
+	taskDefName          string
+	serviceName          string
+	command              []string
+	revision             int
+	launchType           string
+	capacityProviders    capacityProviderOptions
+	placementConstraints placementConstraintOptions
+	placementStrategies  placementStrategyOptions
+	pollInterval         time.Duration
+	timeout              time.Duration
+	useDefaultCommand    bool
+	taskRoleArn          string
+	taskCpu              string
+	taskMemory           string
+	containerName        string
+	containerCommands    keyValueOptions
+	env                  keyValueOptions
+	envFile              string
+	envFromSecrets       keyValueOptions
+	shellExec            bool
+	startedBy            string
+	noSecrets            bool
+	inheritService       bool
+	platformVersion      string
+	showIP               bool
+	awsOpts              awsOptions
+	quiet                bool
+
+	// networkConfiguration is inherited from the service by --inherit-service
+	networkConfiguration *ecs.NetworkConfiguration
 }
 
 func NewOneshotCommand(out, errOut io.Writer) *cobra.Command {
@@ -37,9 +69,17 @@ func NewOneshotCommand(out, errOut io.Writer) *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			f.command = args
 
-			l := log.NewLogger(f.cluster, f.taskDefName, "", out)
+			l := log.NewLogger(f.cluster, f.taskDefName, nil, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			l.Quiet = f.quiet
 			err := f.execute(cmd, args, l)
 			if err != nil {
+				if _, ok := err.(*ExitError); ok {
+					// the task has already reported its failure
+					cmd.SilenceErrors = true
+					cmd.SilenceUsage = true
+					return err
+				}
 				l.Log(fmt.Sprintf("error: %s\n", err.Error()))
 				return err
 			}
@@ -50,10 +90,35 @@ func NewOneshotCommand(out, errOut io.Writer) *cobra.Command {
 	cmd.Flags().StringVar(&f.taskDefName, "taskdef-name", "", "ECS task definition name")
 	cmd.Flags().IntVar(&f.revision, "revision", 0, "revision of ECS task definition")
 	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS service name")
+	cmd.Flags().StringVar(&f.launchType, "launch-type", "", "launch type of the task (EC2 or FARGATE)")
+	cmd.Flags().Var(&f.capacityProviders, "capacity-provider", "capacity provider strategy item (NAME[:WEIGHT[:BASE]])")
+	cmd.Flags().Var(&f.placementConstraints, "placement-constraint", "placement constraint of the task (distinctInstance or memberOf:EXPRESSION)")
+	cmd.Flags().Var(&f.placementStrategies, "placement-strategy", "placement strategy of the task (random, spread:FIELD or binpack:cpu|memory)")
+	cmd.Flags().DurationVar(&f.pollInterval, "poll-interval", 10*time.Second, "interval of polling the task status")
+	cmd.Flags().DurationVar(&f.timeout, "timeout", 0, "timeout of waiting for the task to stop. 0 means no timeout")
+	cmd.Flags().StringVar(&f.taskCpu, "task-cpu", "", "CPU units to override the task size")
+	cmd.Flags().StringVar(&f.taskMemory, "task-memory", "", "memory (MiB) to override the task size")
+	cmd.Flags().StringVar(&f.containerName, "container", "", "container to run COMMAND. the first container by default")
+	cmd.Flags().Var(&f.containerCommands, "container-command", "command of another container (NAME=COMMAND)")
+	cmd.Flags().Var(&f.env, "env", "environment variable of the container (KEY=VALUE)")
+	cmd.Flags().StringVar(&f.envFile, "env-file", "", "path to a dotenv file of environment variables of the container. --env takes precedence")
+	cmd.Flags().Var(&f.envFromSecrets, "env-from-secret", "environment variable from Secrets Manager (KEY=SECRET_ID[:JSON_KEY])")
+	cmd.Flags().StringVar(&f.taskRoleArn, "task-role-arn", "", "IAM role ARN to override the task role")
+	cmd.Flags().StringVar(&f.startedBy, "started-by", "shipctl oneshot", "startedBy of the task, e.g. the CI pipeline or the user")
+	cmd.Flags().StringVar(&f.platformVersion, "platform-version", "", "Fargate platform version of the task, e.g. 1.4.0")
+	cmd.Flags().BoolVar(&f.inheritService, "inherit-service", false, "run the task with the network configuration, launch type and capacity provider strategy of the service of --service-name")
+	cmd.Flags().BoolVar(&f.showIP, "show-ip", false, "print the ENI, private IP and public IP of the task once it is running. requires ec2:DescribeNetworkInterfaces")
+	cmd.Flags().BoolVar(&f.noSecrets, "no-secrets", false, "run the task without secrets of the task definition, e.g. for a debug shell")
+	cmd.Flags().BoolVar(&f.shellExec, "exec", false, "open an interactive shell in a running task of the service by ECS Exec instead of running a new task")
+	cmd.Flags().BoolVar(&f.useDefaultCommand, "use-default-command", false, "run the default command of the container instead of COMMAND")
+	f.awsOpts.addFlags(cmd.Flags())
+	cmd.Flags().BoolVarP(&f.quiet, "quiet", "q", false, "suppress periodic progress messages")
 
 	return cmd
 }
 
+const maxStartedByLength = 128
+
 type specifyingTaskDefStrategy int
 
 const (
@@ -62,6 +127,8 @@ const (
 )
 
 func (f *oneshotCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+	ctx := context.Background()
+
 	strategy := TASK_DEFINITION
 
 	if f.cluster == "" {
@@ -72,43 +139,111 @@ func (f *oneshotCmd) execute(_ *cobra.Command, args []string, l *log.Logger) err
 		return errors.New("--taskdef-name or --service-name is required")
 	}
 
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+	f.cluster, f.serviceName = cluster, serviceName
+
 	if f.taskDefName != "" {
 		strategy = TASK_DEFINITION
 	} else {
 		strategy = SERVICE
 	}
 
-	if len(f.command) == 0 {
+	if f.useDefaultCommand {
+		if len(f.command) > 0 {
+			return errors.New("COMMAND can not be specified with --use-default-command")
+		}
+	} else if len(f.command) == 0 && !f.shellExec {
 		return errors.New("COMMAND is required")
 	}
 
-	region := getAWSRegion()
+	if f.shellExec && strategy != SERVICE {
+		return errors.New("--exec requires --service-name instead of --taskdef-name")
+	}
+
+	if f.inheritService && strategy != SERVICE {
+		return errors.New("--inherit-service requires --service-name instead of --taskdef-name")
+	}
+
+	if f.launchType != "" && len(f.capacityProviders.Value) > 0 {
+		return errors.New("--launch-type and --capacity-provider are mutually exclusive")
+	}
+
+	if f.platformVersion != "" && f.launchType == ecs.LaunchTypeEc2 {
+		return errors.New("--platform-version is not supported on EC2")
+	}
+
+	if len(f.placementConstraints.Value) > 10 {
+		return errors.New("--placement-constraint can be specified up to 10 times")
+	}
+
+	if len(f.placementStrategies.Value) > 5 {
+		return errors.New("--placement-strategy can be specified up to 5 times")
+	}
+
+	if f.launchType == ecs.LaunchTypeFargate && (len(f.placementConstraints.Value) > 0 || len(f.placementStrategies.Value) > 0) {
+		return errors.New("--placement-constraint and --placement-strategy are not supported on FARGATE")
+	}
+
+	// ECS accepts startedBy up to 128 characters
+	if len(f.startedBy) > maxStartedByLength {
+		l.Log(fmt.Sprintf("warning: --started-by is truncated to %d characters\n", maxStartedByLength))
+		f.startedBy = f.startedBy[:maxStartedByLength]
+	}
+
+	if f.pollInterval <= 0 {
+		return errors.New("--poll-interval must be positive")
+	}
+
+	// the launch type inherited from the service or the task definition is checked after they are described
+	err = f.validateTaskSize(nil)
+	if err != nil {
+		return err
+	}
+
+	region := f.awsOpts.resolveRegion()
 	if region == "" {
-		return errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
 	}
 
-	sess, err := session.NewSession()
+	sess, err := newAWSSession(&f.awsOpts)
 	if err != nil {
 		return err
 	}
 
-	client := ecs.New(sess, &aws.Config{
-		Region: aws.String(region),
-	})
+	err = checkCredentials(ctx, sess, f.awsOpts.config(region), l)
+	if err != nil {
+		return err
+	}
+
+	client := ecs.New(sess, f.awsOpts.config(region))
+
+	if f.shellExec {
+		return f.execCommand(ctx, client, region, l)
+	}
 
 	var arn string
 	if strategy == TASK_DEFINITION {
-		taskDef, err := libecs.DescribeTaskDefinition(client, f.taskDefName)
+		taskDef, err := libecs.DescribeTaskDefinition(ctx, client, f.taskDefName)
 		if err != nil {
 			return err
 		}
 		arn = *taskDef.TaskDefinitionArn
 	} else {
-		service, err := libecs.DescribeService(client, f.cluster, f.serviceName)
+		service, err := describeService(ctx, client, f.cluster, f.serviceName, region, l)
 		if err != nil {
 			return err
 		}
 		arn = *service.TaskDefinition
+
+		if f.inheritService {
+			f.inherit(service, l)
+			if f.platformVersion != "" && f.launchType == ecs.LaunchTypeEc2 {
+				return errors.New(fmt.Sprintf("--platform-version is not supported on EC2. %s runs on EC2", f.serviceName))
+			}
+		}
 	}
 
 	arn, err = libecs.SpecifyRevision(f.revision, arn)
@@ -116,12 +251,84 @@ func (f *oneshotCmd) execute(_ *cobra.Command, args []string, l *log.Logger) err
 		return err
 	}
 
-	taskDef, err := libecs.DescribeTaskDefinition(client, arn)
+	taskDef, err := libecs.DescribeTaskDefinition(ctx, client, arn)
+	if err != nil {
+		return err
+	}
+
+	err = f.validateTaskSize(taskDef)
 	if err != nil {
 		return err
 	}
 
-	task, err := f.runTask(client, taskDef, f.command)
+	err = f.resolveContainers(taskDef)
+	if err != nil {
+		return err
+	}
+
+	var environment []*ecs.KeyValuePair
+	{
+		var values []*keyValue
+		if f.envFile != "" {
+			values, err = parseEnvFile(f.envFile)
+			if err != nil {
+				return err
+			}
+		}
+		values = append(values, f.env.Value...)
+
+		// later values override earlier ones of the same key
+		index := map[string]int{}
+		for _, v := range values {
+			if i, ok := index[v.Key]; ok {
+				environment[i].Value = aws.String(v.Value)
+				continue
+			}
+			index[v.Key] = len(environment)
+			environment = append(environment, &ecs.KeyValuePair{
+				Name:  aws.String(v.Key),
+				Value: aws.String(v.Value),
+			})
+		}
+	}
+
+	if len(f.envFromSecrets.Value) > 0 {
+		l.Log("warning: values of --env-from-secret are visible in the task overrides. use secrets of the task definition for production\n")
+
+		secretsClient := secretsmanager.New(sess, f.awsOpts.config(region))
+		for _, v := range f.envFromSecrets.Value {
+			value, err := f.getSecretValue(secretsClient, v.Value)
+			if err != nil {
+				return err
+			}
+			environment = append(environment, &ecs.KeyValuePair{
+				Name:  aws.String(v.Key),
+				Value: aws.String(value),
+			})
+		}
+	}
+
+	// container overrides can not remove secrets, so a revision without secrets is registered for the task
+	var secretlessTaskDef *ecs.TaskDefinition
+	if f.noSecrets && hasSecrets(taskDef) {
+		secretlessTaskDef, err = libecs.RegisterTaskDefinition(ctx, client, withoutSecrets(taskDef), nil)
+		if err != nil {
+			return err
+		}
+		l.Log(fmt.Sprintf("registered %s without secrets\n", *secretlessTaskDef.TaskDefinitionArn))
+		taskDef = secretlessTaskDef
+	}
+
+	task, err := f.runTask(ctx, client, taskDef, f.command, environment)
+
+	if secretlessTaskDef != nil {
+		// the started task keeps running after its task definition is deregistered
+		derr := libecs.DeregisterTaskDefinition(ctx, client, *secretlessTaskDef.TaskDefinitionArn)
+		if derr != nil {
+			l.Log(fmt.Sprintf("warning: failed to deregister %s: %s\n", *secretlessTaskDef.TaskDefinitionArn, derr.Error()))
+		}
+	}
+
 	if err != nil {
 		return err
 	}
@@ -129,50 +336,177 @@ func (f *oneshotCmd) execute(_ *cobra.Command, args []string, l *log.Logger) err
 	l.Log("Task started\n")
 	l.Log(fmt.Sprintf("Task ID: %s\n", f.getTaskID(task)))
 
-	status, err := f.waitTask(client, task, l)
+	// the EC2 client is only created with --show-ip, so that the permission is not required otherwise
+	var ec2Client *ec2.EC2
+	if f.showIP {
+		ec2Client = ec2.New(sess, f.awsOpts.config(region))
+	}
+
+	status, err := f.waitTask(ctx, client, ec2Client, task, l)
 	if err != nil {
 		return err
 	}
 
 	var awslogs *cloudwatchlogs.CloudWatchLogs = nil
 	if f.hasAwslogsConfig(taskDef) {
-		awslogs = cloudwatchlogs.New(sess, &aws.Config{
-			Region: aws.String(region),
-		})
+		awslogs = cloudwatchlogs.New(sess, f.awsOpts.config(region))
 	}
 	f.outputTaskLogs(awslogs, taskDef, f.getTaskID(task), l)
 
-	os.Exit(status.ExitCode)
+	if status.ExitCode == 0 {
+		l.Log("Task completed successfully\n")
+	} else {
+		l.Log(fmt.Sprintf("Task failed with exit code %d\n", status.ExitCode))
+		if status.StoppedReason != "" {
+			l.Log(fmt.Sprintf("Stopped reason: %s\n", status.StoppedReason))
+		}
+		if status.ContainerReason != "" {
+			l.Log(fmt.Sprintf("Container reason: %s\n", status.ContainerReason))
+		}
+		return &ExitError{Code: status.ExitCode}
+	}
 
 	return nil
 }
 
+// resolveContainers validates containers of --container and --container-command in the task definition.
+// f.containerName is set to the first container if --container is not specified
+func (f *oneshotCmd) resolveContainers(taskDef *ecs.TaskDefinition) error {
+	if f.containerName == "" {
+		f.containerName = *taskDef.ContainerDefinitions[0].Name
+	} else if f.findContainer(taskDef, f.containerName) == nil {
+		return errors.New(fmt.Sprintf("container %s is not found in %s", f.containerName, *taskDef.TaskDefinitionArn))
+	}
+
+	seen := map[string]bool{f.containerName: true}
+	for _, v := range f.containerCommands.Value {
+		if f.findContainer(taskDef, v.Key) == nil {
+			return errors.New(fmt.Sprintf("container %s is not found in %s", v.Key, *taskDef.TaskDefinitionArn))
+		}
+		if seen[v.Key] {
+			return errors.New(fmt.Sprintf("command of container %s is specified more than once", v.Key))
+		}
+		seen[v.Key] = true
+	}
+
+	return nil
+}
+
+func (f *oneshotCmd) findContainer(taskDef *ecs.TaskDefinition, name string) *ecs.ContainerDefinition {
+	for _, v := range taskDef.ContainerDefinitions {
+		if aws.StringValue(v.Name) == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// taskVisibilityTimeout is how long to tolerate a task that is not visible yet after RunTask
+const taskVisibilityTimeout = 1 * time.Minute
+
+var errTaskNotFound = errors.New("task is not found")
+
 type taskStatus struct {
-	ExitCode      int
-	StoppedReason string
+	ExitCode        int
+	StoppedReason   string
+	ContainerReason string
 }
 
-func (f *oneshotCmd) runTask(client *ecs.ECS, taskDef *ecs.TaskDefinition, command []string) (*ecs.Task, error) {
-	var commands []*string
-	for _, v := range command {
-		commands = append(commands, aws.String(v))
+// inherit copies the network configuration, the launch type and the capacity provider strategy of the service,
+// so that the task runs in the same environment as the service. --launch-type and --capacity-provider take precedence
+func (f *oneshotCmd) inherit(service *ecs.Service, l *log.Logger) {
+	f.networkConfiguration = service.NetworkConfiguration
+
+	if f.launchType != "" || len(f.capacityProviders.Value) > 0 {
+		return
+	}
+
+	if len(service.CapacityProviderStrategy) > 0 {
+		f.capacityProviders.Value = service.CapacityProviderStrategy
+		l.Debug(fmt.Sprintf("inherit the capacity provider strategy of %s\n", f.serviceName))
+	} else if aws.StringValue(service.LaunchType) != "" {
+		f.launchType = aws.StringValue(service.LaunchType)
+		l.Debug(fmt.Sprintf("inherit the launch type %s of %s\n", f.launchType, f.serviceName))
+	}
+}
+
+func (f *oneshotCmd) runTask(ctx context.Context, client libecs.ECSAPI, taskDef *ecs.TaskDefinition, command []string, environment []*ecs.KeyValuePair) (*ecs.Task, error) {
+	containerOverride := &ecs.ContainerOverride{
+		Name: aws.String(f.containerName),
+	}
+
+	if len(environment) > 0 {
+		containerOverride.Environment = environment
+	}
+
+	// an empty command runs the default command of the container
+	if len(command) > 0 {
+		var commands []*string
+		for _, v := range command {
+			commands = append(commands, aws.String(v))
+		}
+		containerOverride.Command = commands
+	}
+
+	containerOverrides := []*ecs.ContainerOverride{containerOverride}
+	for _, v := range f.containerCommands.Value {
+		var commands []*string
+		for _, w := range strings.Fields(v.Value) {
+			commands = append(commands, aws.String(w))
+		}
+		containerOverrides = append(containerOverrides, &ecs.ContainerOverride{
+			Name:    aws.String(v.Key),
+			Command: commands,
+		})
 	}
 
 	params := &ecs.RunTaskInput{
 		Cluster:        aws.String(f.cluster),
 		TaskDefinition: taskDef.TaskDefinitionArn,
 		Overrides: &ecs.TaskOverride{
-			ContainerOverrides: []*ecs.ContainerOverride{
-				{
-					Name:    taskDef.ContainerDefinitions[0].Name,
-					Command: commands,
-				},
-			},
+			ContainerOverrides: containerOverrides,
 		},
 		Count:     aws.Int64(1),
-		StartedBy: aws.String("shipctl oneshot"),
+		StartedBy: aws.String(f.startedBy),
+	}
+
+	if f.taskRoleArn != "" {
+		params.Overrides.TaskRoleArn = aws.String(f.taskRoleArn)
+	}
+
+	if f.taskCpu != "" {
+		params.Overrides.Cpu = aws.String(f.taskCpu)
+	}
+
+	if f.taskMemory != "" {
+		params.Overrides.Memory = aws.String(f.taskMemory)
+	}
+
+	if f.launchType != "" {
+		params.LaunchType = aws.String(f.launchType)
+	}
+
+	if len(f.capacityProviders.Value) > 0 {
+		params.CapacityProviderStrategy = f.capacityProviders.Value
+	}
+
+	if f.platformVersion != "" {
+		params.PlatformVersion = aws.String(f.platformVersion)
+	}
+
+	if f.networkConfiguration != nil {
+		params.NetworkConfiguration = f.networkConfiguration
+	}
+
+	if len(f.placementConstraints.Value) > 0 {
+		params.PlacementConstraints = f.placementConstraints.Value
+	}
+
+	if len(f.placementStrategies.Value) > 0 {
+		params.PlacementStrategy = f.placementStrategies.Value
 	}
-	res, err := client.RunTask(params)
+
+	res, err := client.RunTaskWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -188,71 +522,358 @@ func (f *oneshotCmd) runTask(client *ecs.ECS, taskDef *ecs.TaskDefinition, comma
 	return res.Tasks[0], nil
 }
 
-func (f *oneshotCmd) waitTask(client *ecs.ECS, task *ecs.Task, l *log.Logger) (*taskStatus, error) {
+// execCommand opens an interactive session to a running task of the service by ECS Exec.
+// the session is handled by session-manager-plugin in the same way as `aws ecs execute-command`
+func (f *oneshotCmd) execCommand(ctx context.Context, client libecs.ECSAPI, region string, l *log.Logger) error {
+	pluginPath, err := exec.LookPath("session-manager-plugin")
+	if err != nil {
+		return errors.New("session-manager-plugin is not found. please install it to use --exec")
+	}
+
+	list, err := client.ListTasksWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       aws.String(f.cluster),
+		ServiceName:   aws.String(f.serviceName),
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	})
+	if err != nil {
+		return err
+	}
+	if len(list.TaskArns) == 0 {
+		return errors.New(fmt.Sprintf("no running task of %s is found", f.serviceName))
+	}
+
+	res, err := client.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(f.cluster),
+		Tasks:   list.TaskArns[:1],
+	})
+	if err != nil {
+		return err
+	}
+	if len(res.Tasks) == 0 || len(res.Tasks[0].Containers) == 0 {
+		return errors.New(fmt.Sprintf("task %s can not be described", *list.TaskArns[0]))
+	}
+	task := res.Tasks[0]
+	taskID := f.getTaskID(task)
+
+	if !aws.BoolValue(task.EnableExecuteCommand) {
+		return errors.New(fmt.Sprintf("ECS Exec is not enabled on task %s. please update the service with enableExecuteCommand", taskID))
+	}
+
+	container := task.Containers[0]
+	if f.containerName != "" {
+		container = nil
+		for _, v := range task.Containers {
+			if aws.StringValue(v.Name) == f.containerName {
+				container = v
+			}
+		}
+		if container == nil {
+			return errors.New(fmt.Sprintf("container %s is not found in task %s", f.containerName, taskID))
+		}
+	}
+
+	command := strings.Join(f.command, " ")
+	if command == "" {
+		command = "/bin/sh"
+	}
+
+	l.Log(fmt.Sprintf("exec %s in container %s of task %s\n", command, *container.Name, taskID))
+
+	out, err := client.ExecuteCommandWithContext(ctx, &ecs.ExecuteCommandInput{
+		Cluster:     aws.String(f.cluster),
+		Task:        task.TaskArn,
+		Container:   container.Name,
+		Command:     aws.String(command),
+		Interactive: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	sessionJSON, err := json.Marshal(out.Session)
+	if err != nil {
+		return err
+	}
+
+	target, err := json.Marshal(map[string]string{
+		"Target": fmt.Sprintf("ecs:%s_%s_%s", f.cluster, taskID, aws.StringValue(container.RuntimeId)),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C is for the remote shell, not for shipctl
+	signal.Ignore(syscall.SIGINT)
+	defer signal.Reset(syscall.SIGINT)
+
+	plugin := exec.Command(pluginPath, string(sessionJSON), region, "StartSession", "", string(target), fmt.Sprintf("https://ecs.%s.amazonaws.com", region))
+	plugin.Stdin = os.Stdin
+	plugin.Stdout = os.Stdout
+	plugin.Stderr = os.Stderr
+
+	return plugin.Run()
+}
+
+// parseEnvFile reads KEY=VALUE lines of a dotenv file.
+// blank lines and lines starting with # are ignored, and quotes around a value are removed
+func parseEnvFile(path string) ([]*keyValue, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, _ := regexp.Compile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+	var values []*keyValue
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		matches := r.FindStringSubmatch(line)
+		if len(matches) == 0 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: invalid format %s", path, i+1, line))
+		}
+
+		value := matches[2]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		values = append(values, &keyValue{Key: matches[1], Value: value})
+	}
+
+	return values, nil
+}
+
+func hasSecrets(taskDef *ecs.TaskDefinition) bool {
+	for _, v := range taskDef.ContainerDefinitions {
+		if len(v.Secrets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutSecrets returns a copy of the task definition whose containers have no secrets.
+// environment variables are kept
+func withoutSecrets(taskDef *ecs.TaskDefinition) *ecs.TaskDefinition {
+	newTaskDef := *taskDef // shallow copy
+	var containers []*ecs.ContainerDefinition
+	for _, vp := range taskDef.ContainerDefinitions {
+		v := *vp // shallow copy
+		v.Secrets = nil
+		containers = append(containers, &v)
+	}
+	newTaskDef.ContainerDefinitions = containers
+	return &newTaskDef
+}
+
+// getSecretValue resolves a value of the form SECRET_ID[:JSON_KEY].
+// SECRET_ID is the name or the ARN of the secret.
+func (f *oneshotCmd) getSecretValue(client *secretsmanager.SecretsManager, v string) (string, error) {
+	secretID := v
+	jsonKey := ""
+	if strings.HasPrefix(v, "arn:") {
+		// arn:aws:secretsmanager:REGION:ACCOUNT:secret:NAME
+		parts := strings.SplitN(v, ":", 8)
+		if len(parts) == 8 {
+			secretID = strings.Join(parts[:7], ":")
+			jsonKey = parts[7]
+		}
+	} else if i := strings.LastIndex(v, ":"); i >= 0 {
+		secretID = v[:i]
+		jsonKey = v[i+1:]
+	}
+
+	res, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if res.SecretString == nil {
+		return "", errors.New(fmt.Sprintf("secret %s is not a string", secretID))
+	}
+
+	if jsonKey == "" {
+		return *res.SecretString, nil
+	}
+
+	var values map[string]interface{}
+	err = json.Unmarshal([]byte(*res.SecretString), &values)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("secret %s is not a JSON object", secretID))
+	}
+
+	value, ok := values[jsonKey]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("key %s is not found in secret %s", jsonKey, secretID))
+	}
+
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	return fmt.Sprintf("%v", value), nil
+}
+
+func (f *oneshotCmd) waitTask(ctx context.Context, client libecs.ECSAPI, ec2Client *ec2.EC2, task *ecs.Task, l *log.Logger) (*taskStatus, error) {
 	start := time.Now()
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	t := time.NewTicker(10 * time.Second)
+	t := time.NewTicker(f.pollInterval)
+	defer t.Stop()
+	var timeout <-chan time.Time
+	if f.timeout > 0 {
+		timeout = time.After(f.timeout)
+	}
 	label := "running"
+	lastStatus := aws.StringValue(task.LastStatus)
+	visible := false
+	ipShown := false
 	for {
 		select {
 		case <-t.C:
-			re, err := f.describeTask(client, task)
+			re, err := f.describeTask(ctx, client, task)
+			if err == errTaskNotFound && !visible && time.Now().Sub(start) < taskVisibilityTimeout {
+				// the task may not be visible yet right after RunTask
+				l.Progress(fmt.Sprintf("waiting for the task to be visible...\n"))
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
+			visible = true
+			lastStatus = *re.LastStatus
 
 			elapsed := time.Now().Sub(start)
-			l.Log(fmt.Sprintf("still %s... [%s]\n", label, (elapsed/time.Second)*time.Second))
+			l.Progress(fmt.Sprintf("still %s... [%s]\n", label, (elapsed/time.Second)*time.Second))
+
+			if ec2Client != nil && !ipShown && *re.LastStatus == "RUNNING" {
+				ipShown = true
+				err = f.showNetworkInterface(ec2Client, re, l)
+				if err != nil {
+					l.Log(fmt.Sprintf("warning: failed to describe the network interface: %s\n", err.Error()))
+				}
+			}
 
 			if *re.LastStatus == "STOPPED" {
+				container := re.Containers[0]
+				for _, v := range re.Containers {
+					if aws.StringValue(v.Name) == f.containerName {
+						container = v
+					}
+				}
 				status := &taskStatus{
-					StoppedReason: *re.StoppedReason,
+					StoppedReason:   aws.StringValue(re.StoppedReason),
+					ContainerReason: aws.StringValue(container.Reason),
 				}
-				if re.Containers[0].ExitCode != nil {
-					status.ExitCode = int(*re.Containers[0].ExitCode)
+				if container.ExitCode != nil {
+					status.ExitCode = int(*container.ExitCode)
+				} else {
+					// the container was stopped before it ran
+					status.ExitCode = 1
 				}
 				return status, nil
 			}
 		case <-sig:
-			f.stopTask(client, task)
+			f.stopTask(ctx, client, task)
 			l.Log(fmt.Sprintf("send stop signal\n"))
 			label = "stopping"
+		case <-timeout:
+			err := f.stopTask(ctx, client, task)
+			if err != nil {
+				l.Log(fmt.Sprintf("failed to stop the task: %s\n", err.Error()))
+			}
+			return nil, errors.New(fmt.Sprintf("timed out after %s waiting for the task to stop. last status: %s", f.timeout, lastStatus))
 		}
 	}
 }
 
-func (f *oneshotCmd) describeTask(client *ecs.ECS, task *ecs.Task) (*ecs.Task, error) {
+// showNetworkInterface logs the ENI of the task and its private and public IPs
+func (f *oneshotCmd) showNetworkInterface(ec2Client *ec2.EC2, task *ecs.Task, l *log.Logger) error {
+	var eniID string
+	for _, v := range task.Attachments {
+		if aws.StringValue(v.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+		for _, d := range v.Details {
+			if aws.StringValue(d.Name) == "networkInterfaceId" {
+				eniID = aws.StringValue(d.Value)
+			}
+		}
+	}
+	if eniID == "" {
+		l.Log("no network interface is attached to the task. the awsvpc network mode is required for --show-ip\n")
+		return nil
+	}
+
+	res, err := ec2Client.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: []*string{aws.String(eniID)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(res.NetworkInterfaces) == 0 {
+		return errors.New(fmt.Sprintf("network interface %s is not found", eniID))
+	}
+	eni := res.NetworkInterfaces[0]
+
+	publicIP := "none"
+	if eni.Association != nil && eni.Association.PublicIp != nil {
+		publicIP = *eni.Association.PublicIp
+	}
+	l.Log(fmt.Sprintf("ENI: %s\n", eniID))
+	l.Log(fmt.Sprintf("Private IP: %s\n", aws.StringValue(eni.PrivateIpAddress)))
+	l.Log(fmt.Sprintf("Public IP: %s\n", publicIP))
+
+	return nil
+}
+
+func (f *oneshotCmd) describeTask(ctx context.Context, client libecs.ECSAPI, task *ecs.Task) (*ecs.Task, error) {
 	params := &ecs.DescribeTasksInput{
 		Tasks: []*string{
 			task.TaskArn,
 		},
 		Cluster: task.ClusterArn,
 	}
-	res, err := client.DescribeTasks(params)
+	res, err := client.DescribeTasksWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(res.Failures) > 0 {
 		msg := ""
+		missing := true
 		for _, v := range res.Failures {
 			msg += fmt.Sprintf("    %s\n", *v.Reason)
+			if aws.StringValue(v.Reason) != "MISSING" {
+				missing = false
+			}
+		}
+		if missing {
+			return nil, errTaskNotFound
 		}
 		return nil, errors.New("failed to runTask\n" + msg)
 	}
 
+	if len(res.Tasks) == 0 {
+		return nil, errTaskNotFound
+	}
+
 	return res.Tasks[0], nil
 }
 
-func (f *oneshotCmd) stopTask(client *ecs.ECS, task *ecs.Task) error {
+func (f *oneshotCmd) stopTask(ctx context.Context, client libecs.ECSAPI, task *ecs.Task) error {
 	params := &ecs.StopTaskInput{
 		Cluster: task.ClusterArn,
 		Reason:  aws.String("SIGINT"),
 		Task:    task.TaskArn,
 	}
 
-	_, err := client.StopTask(params)
+	_, err := client.StopTaskWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
@@ -262,13 +883,14 @@ func (f *oneshotCmd) stopTask(client *ecs.ECS, task *ecs.Task) error {
 
 func (f *oneshotCmd) getTaskID(task *ecs.Task) string {
 	arn := *task.TaskArn
-	r, _ := regexp.Compile(`task/([0-9a-z-]*)$`)
+	// the new ARN format contains the cluster name, e.g. task/CLUSTER/ID
+	r, _ := regexp.Compile(`task/(?:[^/]+/)?([0-9a-z-]*)$`)
 	matches := r.FindStringSubmatch(arn)
 	return matches[1]
 }
 
 func (f *oneshotCmd) hasAwslogsConfig(taskDef *ecs.TaskDefinition) bool {
-	logConfig := taskDef.ContainerDefinitions[0].LogConfiguration
+	logConfig := f.findContainer(taskDef, f.containerName).LogConfiguration
 	if logConfig == nil {
 		return false
 	}
@@ -288,14 +910,14 @@ func (f *oneshotCmd) outputTaskLogs(awslogs *cloudwatchlogs.CloudWatchLogs, task
 		return
 	}
 
-	logConfig := taskDef.ContainerDefinitions[0].LogConfiguration
+	logConfig := f.findContainer(taskDef, f.containerName).LogConfiguration
 	options := logConfig.Options
 
 	params := &cloudwatchlogs.FilterLogEventsInput{
 		LogGroupName: options["awslogs-group"],
 		Interleaved:  aws.Bool(true),
 		LogStreamNames: []*string{
-			aws.String(fmt.Sprintf("%s/%s/%s", *options["awslogs-stream-prefix"], f.serviceName, taskID)),
+			aws.String(fmt.Sprintf("%s/%s/%s", *options["awslogs-stream-prefix"], f.containerName, taskID)),
 		},
 	}
 
@@ -305,6 +927,98 @@ func (f *oneshotCmd) outputTaskLogs(awslogs *cloudwatchlogs.CloudWatchLogs, task
 	}
 
 	for _, v := range res.Events {
-		l.Log(fmt.Sprintf("> %s\n", *v.Message))
+		l.Result(fmt.Sprintf("> %s\n", *v.Message))
+	}
+}
+
+// fargateTaskSizes maps CPU units to the supported memory (MiB) on Fargate
+var fargateTaskSizes = []struct {
+	Cpu    int
+	Memory []int
+}{
+	{256, []int{512, 1024, 2048}},
+	{512, memoryRange(1024, 4096, 1024)},
+	{1024, memoryRange(2048, 8192, 1024)},
+	{2048, memoryRange(4096, 16384, 1024)},
+	{4096, memoryRange(8192, 30720, 1024)},
+	{8192, memoryRange(16384, 61440, 4096)},
+	{16384, memoryRange(32768, 122880, 8192)},
+}
+
+func memoryRange(min, max, step int) []int {
+	var v []int
+	for i := min; i <= max; i += step {
+		v = append(v, i)
+	}
+	return v
+}
+
+// validateTaskSize checks --task-cpu and --task-memory if the task runs on FARGATE.
+// taskDef is nil until it is described, then only --launch-type and --capacity-provider are known
+func (f *oneshotCmd) validateTaskSize(taskDef *ecs.TaskDefinition) error {
+	if f.taskCpu == "" && f.taskMemory == "" {
+		return nil
+	}
+	if !f.runsOnFargate(taskDef) {
+		return nil
+	}
+	if f.taskCpu == "" || f.taskMemory == "" {
+		return errors.New("both --task-cpu and --task-memory are required on FARGATE")
+	}
+	return validateFargateTaskSize(f.taskCpu, f.taskMemory)
+}
+
+// runsOnFargate resolves the launch type in the same order as RunTask:
+// the launch type, the capacity provider strategy, then the compatibilities of the task definition
+func (f *oneshotCmd) runsOnFargate(taskDef *ecs.TaskDefinition) bool {
+	if f.launchType != "" {
+		return f.launchType == ecs.LaunchTypeFargate
+	}
+
+	if len(f.capacityProviders.Value) > 0 {
+		for _, v := range f.capacityProviders.Value {
+			name := aws.StringValue(v.CapacityProvider)
+			if name != "FARGATE" && name != "FARGATE_SPOT" {
+				return false
+			}
+		}
+		return true
+	}
+
+	if taskDef == nil {
+		return false
+	}
+	fargate := false
+	for _, v := range taskDef.RequiresCompatibilities {
+		switch aws.StringValue(v) {
+		case ecs.CompatibilityFargate:
+			fargate = true
+		case ecs.CompatibilityEc2:
+			return false
+		}
+	}
+	return fargate
+}
+
+func validateFargateTaskSize(cpu, memory string) error {
+	c, errCpu := strconv.Atoi(cpu)
+	m, errMemory := strconv.Atoi(memory)
+	if errCpu == nil && errMemory == nil {
+		for _, v := range fargateTaskSizes {
+			if v.Cpu != c {
+				continue
+			}
+			for _, mem := range v.Memory {
+				if mem == m {
+					return nil
+				}
+			}
+		}
+	}
+
+	msg := ""
+	for _, v := range fargateTaskSizes {
+		msg += fmt.Sprintf("    cpu %d: memory %v\n", v.Cpu, v.Memory)
 	}
+	return errors.New(fmt.Sprintf("invalid FARGATE task size cpu %s, memory %s. allowed pairs are\n", cpu, memory) + msg)
 }
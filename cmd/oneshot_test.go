@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestWaitTaskVisibleLate(t *testing.T) {
+	task := &ecs.Task{
+		TaskArn:    aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/foo/0123456789abcdef"),
+		ClusterArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:cluster/foo"),
+		LastStatus: aws.String("PROVISIONING"),
+	}
+
+	// the task is MISSING twice right after RunTask, and then stops
+	calls := 0
+	client := &fakeECS{
+		describeTasks: func(in *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+			calls++
+			if calls <= 2 {
+				return &ecs.DescribeTasksOutput{
+					Failures: []*ecs.Failure{{Arn: task.TaskArn, Reason: aws.String("MISSING")}},
+				}, nil
+			}
+			return &ecs.DescribeTasksOutput{
+				Tasks: []*ecs.Task{{
+					TaskArn:    task.TaskArn,
+					LastStatus: aws.String("STOPPED"),
+					Containers: []*ecs.Container{{
+						Name:     aws.String("app"),
+						ExitCode: aws.Int64(3),
+					}},
+				}},
+			}, nil
+		},
+	}
+
+	f := &oneshotCmd{containerName: "app", pollInterval: time.Millisecond}
+	status, err := f.waitTask(context.Background(), client, nil, task, testLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if status.ExitCode != 3 {
+		t.Errorf("exit code = %d, want 3", status.ExitCode)
+	}
+	if calls != 3 {
+		t.Errorf("described %d times, want 3", calls)
+	}
+}
+
+func TestWaitTaskMissingAfterVisible(t *testing.T) {
+	task := &ecs.Task{
+		TaskArn:    aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/foo/0123456789abcdef"),
+		ClusterArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:cluster/foo"),
+	}
+
+	// a task which disappears after it is seen is an error, not a late visibility
+	calls := 0
+	client := &fakeECS{
+		describeTasks: func(in *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+			calls++
+			if calls == 1 {
+				return &ecs.DescribeTasksOutput{
+					Tasks: []*ecs.Task{{TaskArn: task.TaskArn, LastStatus: aws.String("RUNNING")}},
+				}, nil
+			}
+			return &ecs.DescribeTasksOutput{
+				Failures: []*ecs.Failure{{Arn: task.TaskArn, Reason: aws.String("MISSING")}},
+			}, nil
+		},
+	}
+
+	f := &oneshotCmd{containerName: "app", pollInterval: time.Millisecond}
+	_, err := f.waitTask(context.Background(), client, nil, task, testLogger())
+	if err != errTaskNotFound {
+		t.Errorf("error = %v, want %v", err, errTaskNotFound)
+	}
+}
+
+func TestValidateTaskSizeResolvedLaunchType(t *testing.T) {
+	fargate := &ecs.TaskDefinition{RequiresCompatibilities: aws.StringSlice([]string{ecs.CompatibilityFargate})}
+	ec2 := &ecs.TaskDefinition{RequiresCompatibilities: aws.StringSlice([]string{ecs.CompatibilityEc2})}
+
+	tests := []struct {
+		name       string
+		launchType string
+		taskDef    *ecs.TaskDefinition
+		invalid    bool
+	}{
+		{name: "explicit FARGATE", launchType: ecs.LaunchTypeFargate, invalid: true},
+		{name: "not described yet", taskDef: nil},
+		{name: "FARGATE of the task definition", taskDef: fargate, invalid: true},
+		{name: "EC2 of the task definition", taskDef: ec2},
+		{name: "inherited EC2 takes precedence", launchType: ecs.LaunchTypeEc2, taskDef: fargate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &oneshotCmd{launchType: tt.launchType, taskCpu: "256", taskMemory: "4096"}
+			err := f.validateTaskSize(tt.taskDef)
+			if tt.invalid && err == nil {
+				t.Error("expected an error of the FARGATE task size")
+			}
+			if !tt.invalid && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/cobra"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+// preflightActions are the actions shipctl performs
+var preflightActions = []string{
+	"ecs:DescribeServices",
+	"ecs:DescribeTaskDefinition",
+	"ecs:RegisterTaskDefinition",
+	"ecs:DeregisterTaskDefinition",
+	"ecs:ListTaskDefinitions",
+	"ecs:TagResource",
+	"ecs:UpdateService",
+	"ecs:CreateService",
+	"ecs:RunTask",
+	"ecs:DescribeTasks",
+	"ecs:StopTask",
+	"ecs:ListTasks",
+	"ecs:ListClusters",
+	"ecs:ListServices",
+	"ecs:ExecuteCommand",
+	"ecr:BatchGetImage",
+	"ecr:PutImage",
+	"ecr:DescribeRepositories",
+	"codedeploy:CreateDeployment",
+	"codedeploy:GetDeployment",
+	"ssm:GetParameter",
+	"ssm:PutParameter",
+	"ssm:DescribeParameters",
+	"logs:FilterLogEvents",
+	"secretsmanager:GetSecretValue",
+	"ec2:DescribeNetworkInterfaces",
+	"sts:GetCallerIdentity",
+	"iam:PassRole",
+}
+
+type preflightCmd struct {
+	awsOpts awsOptions
+}
+
+func NewPreflightCommand(out, errOut io.Writer) *cobra.Command {
+	f := &preflightCmd{}
+	cmd := &cobra.Command{
+		Use:     "preflight",
+		Aliases: []string{"validate"},
+		Short:   "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.NewLogger("", "", nil, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			err := f.execute(cmd, args, l)
+			if err != nil {
+				l.Log(fmt.Sprintf("error: %s\n", err.Error()))
+				return err
+			}
+			return nil
+		},
+	}
+	f.awsOpts.addFlags(cmd.Flags())
+
+	return cmd
+}
+
+func (f *preflightCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+	region := f.awsOpts.resolveRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+
+	sess, err := newAWSSession(&f.awsOpts)
+	if err != nil {
+		return err
+	}
+
+	stsClient := sts.New(sess, f.awsOpts.config(region))
+
+	identity, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+
+	principal := f.principalArn(*identity.Arn)
+	l.Log(fmt.Sprintf("principal: %s\n", principal))
+
+	iamClient := iam.New(sess, f.awsOpts.config(region))
+
+	params := &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principal),
+		ActionNames:     aws.StringSlice(preflightActions),
+	}
+
+	denied := 0
+	err = iamClient.SimulatePrincipalPolicyPages(params, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+		for _, v := range page.EvaluationResults {
+			decision := *v.EvalDecision
+			if decision != iam.PolicyEvaluationDecisionTypeAllowed {
+				denied++
+			}
+			l.Result(fmt.Sprintf("%-14s %s\n", decision, *v.EvalActionName))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if denied > 0 {
+		return errors.New(fmt.Sprintf("%d actions are not allowed", denied))
+	}
+
+	l.Log("all actions are allowed\n")
+
+	return nil
+}
+
+// principalArn converts an assumed role ARN to the ARN of the IAM role,
+// because SimulatePrincipalPolicy does not accept STS session ARNs.
+func (f *preflightCmd) principalArn(arn string) string {
+	r, _ := regexp.Compile(`^arn:(aws[a-z-]*):sts::([0-9]+):assumed-role/([^/]+)/.*$`)
+	matches := r.FindStringSubmatch(arn)
+	if len(matches) == 0 {
+		return arn
+	}
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", matches[1], matches[2], matches[3])
+}
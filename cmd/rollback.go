@@ -1,24 +1,44 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/spf13/cobra"
 
 	libecs "github.com/SKAhack/shipctl/lib/ecs"
 	log "github.com/SKAhack/shipctl/lib/logger"
+	"github.com/SKAhack/shipctl/lib/tracing"
 )
 
 type rollbackCmd struct {
-	cluster         string
-	serviceName     string
-	backend         string
-	slackWebhookUrl string
+	cluster          string
+	serviceName      string
+	backend          string
+	slackWebhookUrls []string
+	slackUsername    string
+	slackChannel     string
+	notifyOn         string
+	color            string
+	awsOpts          awsOptions
+	historyOpts      historyOptions
+	quiet            bool
+	toRevision       int
+	list             bool
+	since            string
+	yes              bool
+	pushgatewayURL   string
+
+	// targetRevision is the revision to rollback to. it is set by execute for --pushgateway-url
+	targetRevision int
 }
 
 func NewRollbackCommand(out, errOut io.Writer) *cobra.Command {
@@ -27,11 +47,32 @@ func NewRollbackCommand(out, errOut io.Writer) *cobra.Command {
 		Use:   "rollback [options]",
 		Short: "",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			l := log.NewLogger(f.cluster, f.serviceName, f.slackWebhookUrl, out)
-			err := f.execute(cmd, args, l)
+			slackWebhookUrls, err := resolveSlackWebhookURLs(f.slackWebhookUrls, &f.awsOpts)
+			if err != nil {
+				return err
+			}
+			l := log.NewLogger(f.cluster, f.serviceName, slackWebhookUrls, out, errOut)
+			l.Verbose = f.awsOpts.verbose
+			l.Quiet = f.quiet
+			l.SlackUsername = f.slackUsername
+			l.SlackChannel = f.slackChannel
+			notifyOn, err := log.ParseNotifyOn(f.notifyOn)
+			if err != nil {
+				return err
+			}
+			l.NotifyOn = notifyOn
+			l.Color, err = colorEnabled(f.color, errOut)
+			if err != nil {
+				return err
+			}
+			startedAt := time.Now()
+			err = f.execute(cmd, args, l)
+			if !f.list {
+				pushDeployMetrics(f.pushgatewayURL, "rollback", f.cluster, f.serviceName, int64(f.targetRevision), startedAt, err, l)
+			}
 			if err != nil {
 				msg := fmt.Sprintf("failed to deploy. cluster: %s, serviceName: %s\n", f.cluster, f.serviceName)
-				l.Log(msg)
+				l.Status("danger", msg)
 				l.Slack("danger", msg)
 				return err
 			}
@@ -40,13 +81,31 @@ func NewRollbackCommand(out, errOut io.Writer) *cobra.Command {
 	}
 	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
 	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().IntVar(&f.toRevision, "to-revision", 0, "revision of ECS task definition to rollback to. the latest DEPLOYED revision other than the current one by default")
+	cmd.Flags().BoolVar(&f.list, "list", false, "print rollback targets from history")
+	cmd.Flags().StringVar(&f.since, "since", "", "print only states of --list within the window (e.g. 24h, 2023-01-01)")
+	cmd.Flags().BoolVarP(&f.yes, "yes", "y", false, "rollback without confirmation")
 	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of state manager")
-	cmd.Flags().StringVar(&f.slackWebhookUrl, "slack-webhook-url", "", "slack webhook URL")
+	cmd.Flags().StringArrayVar(&f.slackWebhookUrls, "slack-webhook-url", []string{}, "slack webhook URL with an optional severity filter (URL[#all|info|success|failure]). ssm://NAME reads the URL from the SSM parameter. $SLACK_WEBHOOK_URL by default")
+	cmd.Flags().StringVar(&f.slackUsername, "slack-username", "deploy-bot", "username of slack notifications")
+	cmd.Flags().StringVar(&f.slackChannel, "slack-channel", "", "channel of slack notifications. the default channel of the webhook by default")
+	cmd.Flags().StringVar(&f.notifyOn, "notify-on", "start,success,failure", "comma-separated events to notify to slack (start, success, failure)")
+	cmd.Flags().StringVar(&f.color, "color", "auto", "color success and failure messages (auto, always or never). auto colors them if stderr is a terminal")
+	f.awsOpts.addFlags(cmd.Flags())
+	f.historyOpts.addFlags(cmd.Flags())
+	cmd.Flags().BoolVarP(&f.quiet, "quiet", "q", false, "suppress periodic progress messages")
+	cmd.Flags().StringVar(&f.pushgatewayURL, "pushgateway-url", "", "URL of a Prometheus Pushgateway to push deploy_duration_seconds and deploy_result to at the end of the rollback")
 
 	return cmd
 }
 
-func (f *rollbackCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+func (f *rollbackCmd) execute(_ *cobra.Command, args []string, l *log.Logger) (err error) {
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "rollback")
+	defer func() { tracing.End(span, err) }()
+
 	if f.cluster == "" {
 		return errors.New("--cluster is required")
 	}
@@ -55,21 +114,44 @@ func (f *rollbackCmd) execute(_ *cobra.Command, args []string, l *log.Logger) er
 		return errors.New("--service-name is required")
 	}
 
-	region := getAWSRegion()
+	var since time.Time
+	if f.since != "" {
+		if !f.list {
+			return errors.New("--since can be used only with --list")
+		}
+		v, err := parseSince(f.since, time.Now())
+		if err != nil {
+			return err
+		}
+		since = v
+	}
+
+	cluster, serviceName, err := normalizeNames(f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+	f.cluster, f.serviceName = cluster, serviceName
+	span.SetAttributes(tracing.Service(f.cluster, f.serviceName)...)
+
+	region := f.awsOpts.resolveRegion()
 	if region == "" {
-		return errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
+		return errors.New("AWS region is not found. please set --region, AWS_DEFAULT_REGION or AWS_REGION")
+	}
+	l.ConsoleURL = ecsConsoleURL(region, f.cluster, f.serviceName)
+
+	sess, err := newAWSSession(&f.awsOpts)
+	if err != nil {
+		return err
 	}
 
-	sess, err := session.NewSession()
+	err = checkCredentials(ctx, sess, f.awsOpts.config(region), l)
 	if err != nil {
 		return err
 	}
 
-	client := ecs.New(sess, &aws.Config{
-		Region: aws.String(region),
-	})
+	client := ecs.New(sess, f.awsOpts.config(region))
 
-	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName)
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName, &f.awsOpts, &f.historyOpts)
 	if err != nil {
 		return err
 	}
@@ -78,14 +160,33 @@ func (f *rollbackCmd) execute(_ *cobra.Command, args []string, l *log.Logger) er
 	if err != nil {
 		return err
 	}
-	if len(states) < 2 {
-		return errors.New("can not found a prev state")
+
+	if f.list {
+		printHistory(states, since, l)
+		return nil
 	}
 
-	prevState := states[len(states)-2]
+	if len(states) == 0 {
+		return errors.New("can not found a state")
+	}
 	state := states[len(states)-1]
 
-	service, err := libecs.DescribeService(client, f.cluster, f.serviceName)
+	var targetRevision int
+	if f.toRevision > 0 {
+		if f.toRevision == state.Revision {
+			return errors.New(fmt.Sprintf("revision %d is already deployed", f.toRevision))
+		}
+		targetRevision = f.toRevision
+	} else {
+		targetRevision = defaultRollbackTarget(states)
+		if targetRevision == 0 {
+			return errors.New("can not found a prev state")
+		}
+	}
+	f.targetRevision = targetRevision
+
+	l.Debug(fmt.Sprintf("describe service %s\n", f.serviceName))
+	service, err := describeService(ctx, client, f.cluster, f.serviceName, region, l)
 	if err != nil {
 		return err
 	}
@@ -94,48 +195,136 @@ func (f *rollbackCmd) execute(_ *cobra.Command, args []string, l *log.Logger) er
 		return errors.New(fmt.Sprintf("%s is currently deploying", f.serviceName))
 	}
 
+	currentRevision, err := libecs.RevisionOf(*service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+	if currentRevision != state.Revision {
+		return errors.New(fmt.Sprintf("history is out of sync with the service. the latest state is revision %d but the service is running revision %d", state.Revision, currentRevision))
+	}
+
+	// rollback reverts the service to the existing task definition of the target revision.
+	// no new revision is registered, so the pushed state records targetRevision.
 	var taskDef *ecs.TaskDefinition
 	{
 		taskDefArn := *service.TaskDefinition
-		taskDefArn, err = libecs.SpecifyRevision(prevState.Revision, taskDefArn)
+		taskDefArn, err = libecs.SpecifyRevision(targetRevision, taskDefArn)
 		if err != nil {
 			return err
 		}
 
-		taskDef, err = libecs.DescribeTaskDefinition(client, taskDefArn)
+		l.Debug(fmt.Sprintf("describe task definition %s\n", taskDefArn))
+		taskDef, err = libecs.DescribeTaskDefinition(ctx, client, taskDefArn)
+		if err != nil {
+			return errors.New(fmt.Sprintf("revision %d can not be described: %s\nplease pick a different --to-revision. run with --list to see rollback targets", targetRevision, err.Error()))
+		}
+
+		if aws.StringValue(taskDef.Status) == ecs.TaskDefinitionStatusInactive {
+			return errors.New(fmt.Sprintf("revision %d is deregistered (INACTIVE)\nplease pick a different --to-revision. run with --list to see rollback targets", targetRevision))
+		}
+	}
+
+	if !f.yes {
+		err = f.confirm(state.Revision, targetRevision, l)
 		if err != nil {
 			return err
 		}
 	}
 
 	var msg string
-	msg = fmt.Sprintf("rollback: revision %d -> %d\n", state.Revision, prevState.Revision)
+	msg = fmt.Sprintf("rollback: revision %d -> %d (existing revision)\n", state.Revision, targetRevision)
+	// the images of the target revision are shown by the digests recorded at the deploy
+	for i := len(states) - 1; i >= 0; i-- {
+		if states[i].Revision == targetRevision {
+			msg += digestsMessage(states[i].Digests)
+			break
+		}
+	}
 	l.Log(msg)
 	l.Slack("normal", msg)
 
-	err = libecs.UpdateService(client, service, taskDef)
+	err = rollbackService(
+		ctx, client, historyManager, f.cluster, service, taskDef,
+		fmt.Sprintf("rollback: %d -> %d", state.Revision, targetRevision),
+		l,
+	)
 	if err != nil {
 		return err
 	}
 
+	msg = fmt.Sprintf("successfully updated\n")
+	l.Status("good", msg)
+	l.Slack("good", msg)
+
+	return nil
+}
+
+// defaultRollbackTarget returns the revision of the latest DEPLOYED state other than the revision of the latest state.
+// pending, canary and cancelled revisions never became stable, so they are not rollback targets. 0 means no target
+func defaultRollbackTarget(states []*deployState) int {
+	if len(states) == 0 {
+		return 0
+	}
+
+	current := states[len(states)-1].Revision
+	for i := len(states) - 2; i >= 0; i-- {
+		if states[i].Status == deployStatus_DEPLOYED && states[i].Revision != current {
+			return states[i].Revision
+		}
+	}
+	return 0
+}
+
+// rollbackService updates the service to the existing task definition and records it in history as a DEPLOYED rollback.
+// errors are returned as rollbackFailure
+func rollbackService(ctx context.Context, client libecs.ECSAPI, historyManager historyManager, cluster string, service *ecs.Service, taskDef *ecs.TaskDefinition, cause string, l *log.Logger) error {
+	attrs := append(tracing.Service(cluster, *service.ServiceName), tracing.Revision(*taskDef.Revision))
+
+	l.Debug(fmt.Sprintf("update service %s to %s\n", *service.ServiceName, *taskDef.TaskDefinitionArn))
+	_, updateSpan := tracing.Start(ctx, "update", attrs...)
+	err := libecs.UpdateService(ctx, client, service, taskDef, nil)
+	tracing.End(updateSpan, err)
+	if err != nil {
+		return &rollbackFailure{err: err}
+	}
+
 	l.Log(fmt.Sprintf("service updating\n"))
 
-	err = libecs.WaitUpdateService(client, f.cluster, f.serviceName, l)
+	l.Debug(fmt.Sprintf("wait for service %s to be stable\n", *service.ServiceName))
+	_, waitSpan := tracing.Start(ctx, "wait", attrs...)
+	err = libecs.WaitUpdateService(ctx, client, cluster, *service.ServiceName, true, l)
+	tracing.End(waitSpan, err)
 	if err != nil {
-		return err
+		return &rollbackFailure{err: err}
 	}
 
-	err = historyManager.PushState(
-		prevState.Revision,
-		fmt.Sprintf("rollback: %d -> %d", state.Revision, prevState.Revision),
-	)
+	err = historyManager.PushRollbackState(int(*taskDef.Revision), cause)
+	if err != nil {
+		return &rollbackFailure{err: err}
+	}
+	return nil
+}
+
+func (f *rollbackCmd) confirm(currentRevision, targetRevision int, l *log.Logger) error {
+	fi, err := os.Stdin.Stat()
 	if err != nil {
 		return err
 	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("stdin is not a terminal. pass --yes to rollback without confirmation")
+	}
 
-	msg = fmt.Sprintf("successfully updated\n")
-	l.Log(msg)
-	l.Slack("good", msg)
+	l.Log(fmt.Sprintf("rollback %s/%s: revision %d -> %d\n", f.cluster, f.serviceName, currentRevision, targetRevision))
+	l.Log("type \"yes\" to continue: ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("rollback is cancelled")
+	}
 
 	return nil
 }
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+)
+
+func TestRollbackServiceHistory(t *testing.T) {
+	defer func(v time.Duration) { libecs.WaitInterval = v }(libecs.WaitInterval)
+	libecs.WaitInterval = time.Millisecond
+
+	targetArn := "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/bar:9"
+	tests := []struct {
+		name      string
+		updateErr error
+		// rolloutState is the rollout state of the primary deployment after the update
+		rolloutState string
+		// wantRollback means a DEPLOYED rollback to revision 9 is recorded
+		wantRollback bool
+	}{
+		{name: "success", rolloutState: ecs.DeploymentRolloutStateCompleted, wantRollback: true},
+		{name: "update fails", updateErr: errors.New("update failed")},
+		{name: "deployment fails", rolloutState: ecs.DeploymentRolloutStateFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			historyManager := NewSSMHistoryManagerWithClient(newFakeSSM(), "foo", "bar")
+			err := historyManager.PushState(9, deployStatus_DEPLOYED, "deploy: 8 -> 9")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = historyManager.PushState(10, deployStatus_DEPLOYED, "deploy: 9 -> 10")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			service := &ecs.Service{
+				ClusterArn:     aws.String("arn:aws:ecs:ap-northeast-1:123456789012:cluster/foo"),
+				ServiceName:    aws.String("bar"),
+				TaskDefinition: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/bar:10"),
+				DesiredCount:   aws.Int64(2),
+				RunningCount:   aws.Int64(2),
+			}
+
+			var updatedTo string
+			client := &fakeECS{
+				updateService: func(in *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+					if tt.updateErr != nil {
+						return nil, tt.updateErr
+					}
+					updatedTo = aws.StringValue(in.TaskDefinition)
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+				describeServices: func(in *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+					s := *service // shallow copy
+					s.TaskDefinition = aws.String(updatedTo)
+					s.Deployments = []*ecs.Deployment{{
+						Id:             aws.String("ecs-svc/1"),
+						Status:         aws.String("PRIMARY"),
+						TaskDefinition: aws.String(updatedTo),
+						RolloutState:   aws.String(tt.rolloutState),
+					}}
+					return &ecs.DescribeServicesOutput{Services: []*ecs.Service{&s}}, nil
+				},
+			}
+
+			taskDef := &ecs.TaskDefinition{TaskDefinitionArn: aws.String(targetArn), Revision: aws.Int64(9)}
+			err = rollbackService(context.Background(), client, historyManager, "foo", service, taskDef, "rollback: 10 -> 9", testLogger())
+
+			states, perr := historyManager.Pull()
+			if perr != nil {
+				t.Fatal(perr)
+			}
+			latest := states[len(states)-1]
+
+			if !tt.wantRollback {
+				if _, ok := err.(*rollbackFailure); !ok {
+					t.Errorf("error = %v, want a rollbackFailure", err)
+				}
+				// the history keeps the revision the service was running
+				if len(states) != 2 || latest.Revision != 10 || latest.Status != deployStatus_DEPLOYED {
+					t.Errorf("history is changed by a failed rollback: %+v", latest)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if updatedTo != targetArn {
+				t.Errorf("service is updated to %s, want %s", updatedTo, targetArn)
+			}
+
+			// the existing revision the service runs now is recorded, not a new one
+			revision, rerr := libecs.RevisionOf(updatedTo)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			if len(states) != 3 || latest.Revision != revision || latest.Status != deployStatus_DEPLOYED || latest.GetKind() != deployKind_ROLLBACK {
+				t.Errorf("history does not match the service running revision %d: %+v", revision, latest)
+			}
+			if latest.Cause != "rollback: 10 -> 9" {
+				t.Errorf("cause = %s", latest.Cause)
+			}
+		})
+	}
+}
+
+func TestDefaultRollbackTarget(t *testing.T) {
+	state := func(revision int, status deployStatus) *deployState {
+		return &deployState{Revision: revision, Status: status}
+	}
+
+	tests := []struct {
+		name   string
+		states []*deployState
+		want   int
+	}{
+		{name: "no history", states: nil, want: 0},
+		{name: "only the current state", states: []*deployState{state(10, deployStatus_DEPLOYED)}, want: 0},
+		{
+			name:   "previous deploy",
+			states: []*deployState{state(9, deployStatus_DEPLOYED), state(10, deployStatus_DEPLOYED)},
+			want:   9,
+		},
+		{
+			name:   "failed deploys are skipped",
+			states: []*deployState{state(8, deployStatus_DEPLOYED), state(9, deployStatus_PENDING), state(10, deployStatus_DEPLOYED)},
+			want:   8,
+		},
+		{
+			name:   "cancelled and canary deploys are skipped",
+			states: []*deployState{state(7, deployStatus_DEPLOYED), state(8, deployStatus_CANCELLED), state(9, deployStatus_CANARY), state(10, deployStatus_DEPLOYED)},
+			want:   7,
+		},
+		{
+			name:   "the current revision is skipped",
+			states: []*deployState{state(9, deployStatus_DEPLOYED), state(10, deployStatus_DEPLOYED), state(11, deployStatus_PENDING), state(10, deployStatus_DEPLOYED)},
+			want:   9,
+		},
+		{
+			name:   "no deployed state",
+			states: []*deployState{state(9, deployStatus_PENDING), state(10, deployStatus_DEPLOYED)},
+			want:   0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultRollbackTarget(tt.states); got != tt.want {
+				t.Errorf("target = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// renderTaskDefinition renders a task definition JSON from a Go template.
+// The template can refer to the values file as `{{ .key }}` and to environment variables as `{{ env "KEY" }}`.
+func renderTaskDefinition(templatePath, valuesPath string) (*ecs.TaskDefinition, error) {
+	values := map[string]interface{}{}
+	if valuesPath != "" {
+		b, err := ioutil.ReadFile(valuesPath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &values)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to parse values file %s: %s", valuesPath, err.Error()))
+		}
+	}
+
+	tmpl, err := template.New(filepath.Base(templatePath)).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"env": os.Getenv}).
+		ParseFiles(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// the field names of the rendered JSON are the same as `aws ecs describe-task-definition`
+	var taskDef ecs.TaskDefinition
+	err = json.Unmarshal(buf.Bytes(), &taskDef)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse rendered task definition %s: %s", templatePath, err.Error()))
+	}
+
+	if taskDef.Family == nil || *taskDef.Family == "" {
+		return nil, errors.New(fmt.Sprintf("family is not found in rendered task definition %s", templatePath))
+	}
+
+	return &taskDef, nil
+}
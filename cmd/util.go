@@ -1,6 +1,272 @@
 package cmd
 
-import "os"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/pflag"
+
+	"github.com/SKAhack/shipctl/lib/awsutil"
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+	"github.com/SKAhack/shipctl/lib/metrics"
+	"github.com/SKAhack/shipctl/lib/tracing"
+)
+
+const defaultMaxRetries int = 10
+
+// exit codes of the process, which are stable for orchestrators parsing them.
+// oneshot exits with the exit code of the task instead, by ExitError
+const (
+	ExitCodeSuccess = 0
+	// ExitCodeError is for usage and validation errors, and errors not classified below
+	ExitCodeError = 1
+	// ExitCodeDeployFailure is for deployments which failed to be stable, timed out or were interrupted
+	ExitCodeDeployFailure = 2
+	// ExitCodeAWSError is for errors of AWS API calls, e.g. missing permissions or throttling
+	ExitCodeAWSError = 3
+	// ExitCodeRollbackFailure is for failures of rollback, cancel and auto-rollback
+	ExitCodeRollbackFailure = 4
+)
+
+// ExitError makes the process exit with the code, e.g. the exit code of a oneshot task
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// deployFailure is an error of a deployment which failed to be stable
+type deployFailure struct {
+	err error
+}
+
+func (e *deployFailure) Error() string {
+	return e.err.Error()
+}
+
+func (e *deployFailure) Unwrap() error {
+	return e.err
+}
+
+// newDeployFailure wraps an error of waiting for a deployment.
+// errors of AWS API calls are kept as is, since the deployment itself did not fail
+func newDeployFailure(err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return err
+	}
+	return &deployFailure{err: err}
+}
+
+// rollbackFailure is an error of rolling back a service, including errors of AWS API calls
+type rollbackFailure struct {
+	err error
+}
+
+func (e *rollbackFailure) Error() string {
+	return e.err.Error()
+}
+
+func (e *rollbackFailure) Unwrap() error {
+	return e.err
+}
+
+// ExitCodeOf returns the exit code of the process for an error returned by a command.
+// wrapped errors are classified too, by the first matching type in the order below
+func ExitCodeOf(err error) int {
+	var exitErr *ExitError
+	var rollbackErr *rollbackFailure
+	var deployErr *deployFailure
+	var aerr awserr.Error
+
+	switch {
+	case err == nil:
+		return ExitCodeSuccess
+	case errors.As(err, &exitErr):
+		return exitErr.Code
+	case errors.As(err, &rollbackErr):
+		return ExitCodeRollbackFailure
+	case errors.As(err, &deployErr):
+		return ExitCodeDeployFailure
+	case errors.As(err, &aerr):
+		return ExitCodeAWSError
+	}
+	return ExitCodeError
+}
+
+// awsOptions holds flags for AWS clients common to the commands
+type awsOptions struct {
+	maxRetries int
+	verbose    bool
+	// profile is the profile of the shared config. $AWS_PROFILE by default
+	profile string
+	// region overrides the region of the environment variables. each cluster of deploy --cluster-list may override it again
+	region string
+}
+
+func (o *awsOptions) addFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&o.maxRetries, "max-retries", defaultMaxRetries, "max number of retries for throttled or failed AWS API calls")
+	flags.BoolVarP(&o.verbose, "verbose", "v", false, "log AWS API requests and responses")
+	flags.StringVar(&o.profile, "profile", "", "AWS profile of the shared config. $AWS_PROFILE by default")
+	flags.StringVar(&o.region, "region", "", "AWS region. $AWS_REGION or $AWS_DEFAULT_REGION by default")
+}
+
+// resolveRegion returns the region of AWS clients
+func (o *awsOptions) resolveRegion() string {
+	if o.region != "" {
+		return o.region
+	}
+	return getAWSRegion()
+}
+
+// config returns a config of AWS clients.
+// Throttled requests are retried by the default retryer with exponential backoff.
+func (o *awsOptions) config(region string) *aws.Config {
+	config := &aws.Config{
+		Region:     aws.String(region),
+		MaxRetries: aws.Int(o.maxRetries),
+	}
+
+	if o.verbose {
+		config.LogLevel = aws.LogLevel(aws.LogDebugWithHTTPBody)
+		config.Logger = aws.LoggerFunc(func(args ...interface{}) {
+			fmt.Fprintln(os.Stderr, args...)
+		})
+	}
+
+	return config
+}
+
+// sessionOptions returns options of a session which also loads ~/.aws/config,
+// so that profiles of AWS SSO and credential_process are resolved
+func (o *awsOptions) sessionOptions() session.Options {
+	opts := session.Options{
+		Profile:           o.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if region := o.resolveRegion(); region != "" {
+		opts.Config.Region = aws.String(region)
+	}
+	return opts
+}
+
+// newAWSSession returns a session of the profile and the region of awsOpts
+func newAWSSession(awsOpts *awsOptions) (*session.Session, error) {
+	return session.NewSessionWithOptions(awsOpts.sessionOptions())
+}
+
+// checkCredentials fails early if AWS credentials are missing or expired,
+// before any operation is done
+func checkCredentials(ctx context.Context, sess *session.Session, config *aws.Config, l *log.Logger) error {
+	client := sts.New(sess, config)
+
+	identity, err := client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		// the AWS error is kept to exit with ExitCodeAWSError
+		return fmt.Errorf("unable to resolve AWS credentials: %w", awsutil.WrapError(err))
+	}
+
+	l.Debug(fmt.Sprintf("account: %s, principal: %s\n", aws.StringValue(identity.Account), aws.StringValue(identity.Arn)))
+
+	return nil
+}
+
+// normalizeNames accepts names or ARNs of the cluster and the service, and returns their names.
+// the names are used in history keys and messages, so that both forms refer to the same service
+func normalizeNames(cluster, serviceName string, l *log.Logger) (string, string, error) {
+	cluster, err := libecs.ClusterNameOf(cluster)
+	if err != nil {
+		return "", "", err
+	}
+
+	if serviceName != "" {
+		serviceName, err = libecs.ServiceNameOf(cluster, serviceName)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	l.Cluster = cluster
+	l.ServiceName = serviceName
+
+	return cluster, serviceName, nil
+}
+
+// describeService describes the service with a helpful error if it is not found
+func describeService(ctx context.Context, client libecs.ECSAPI, cluster, serviceName, region string, l *log.Logger) (*ecs.Service, error) {
+	_, span := tracing.Start(ctx, "describe", tracing.Service(cluster, serviceName)...)
+	service, err := libecs.DescribeService(ctx, client, cluster, serviceName)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, serviceNotFoundError(ctx, client, cluster, serviceName, region, err, l)
+	}
+	return service, nil
+}
+
+// serviceNotFoundError returns an error with the region if err means the service or the cluster is not found,
+// since a wrong region is the common cause. with --verbose, clusters and services of the region are listed
+func serviceNotFoundError(ctx context.Context, client libecs.ECSAPI, cluster, serviceName, region string, err error, l *log.Logger) error {
+	aerr, ok := err.(awserr.Error)
+	if err != libecs.ErrServiceNotFound && !(ok && aerr.Code() == ecs.ErrCodeClusterNotFoundException) {
+		return err
+	}
+
+	if l.Verbose {
+		clusters, lerr := libecs.ListClusterNames(ctx, client)
+		if lerr == nil {
+			l.Log(fmt.Sprintf("clusters in %s: %s\n", region, strings.Join(clusters, ", ")))
+		}
+		services, lerr := libecs.ListServiceNames(ctx, client, cluster)
+		if lerr == nil {
+			l.Log(fmt.Sprintf("services of %s in %s: %s\n", cluster, region, strings.Join(services, ", ")))
+		}
+	}
+
+	return errors.New(fmt.Sprintf("service %s is not found in cluster %s of region %s. is the region correct?", serviceName, cluster, region))
+}
+
+// optionalInt64 returns nil for -1, which means an unset flag
+func optionalInt64(v int64) *int64 {
+	if v < 0 {
+		return nil
+	}
+	return aws.Int64(v)
+}
+
+// newSignalContext returns a context which is cancelled on SIGINT or SIGTERM
+func newSignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, cancel
+}
 
 func getAWSRegion() string {
 	if os.Getenv("AWS_REGION") != "" {
@@ -13,3 +279,389 @@ func getAWSRegion() string {
 
 	return ""
 }
+
+//
+// capacityProviderOptions
+//
+
+type capacityProviderOptions struct {
+	Value []*ecs.CapacityProviderStrategyItem
+}
+
+func (t *capacityProviderOptions) String() string {
+	return fmt.Sprintf("String: %v", t.Value)
+}
+
+// Set parses a value of the form NAME[:WEIGHT[:BASE]]
+func (t *capacityProviderOptions) Set(v string) error {
+	r, _ := regexp.Compile(`^([a-zA-Z0-9_-]+)(?::([0-9]+)(?::([0-9]+))?)?$`)
+	matches := r.FindStringSubmatch(v)
+	if len(matches) == 0 {
+		return errors.New(fmt.Sprintf("invalid format %s", v))
+	}
+
+	item := &ecs.CapacityProviderStrategyItem{
+		CapacityProvider: aws.String(matches[1]),
+	}
+
+	if matches[2] != "" {
+		weight, err := strconv.ParseInt(matches[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		item.Weight = aws.Int64(weight)
+	}
+
+	if matches[3] != "" {
+		base, err := strconv.ParseInt(matches[3], 10, 64)
+		if err != nil {
+			return err
+		}
+		item.Base = aws.Int64(base)
+	}
+
+	t.Value = append(t.Value, item)
+
+	return nil
+}
+
+func (t *capacityProviderOptions) Type() string {
+	return "capacityProvider"
+}
+
+//
+// keyValueOptions
+//
+
+type keyValue struct {
+	Key   string
+	Value string
+}
+
+type keyValueOptions struct {
+	Value []*keyValue
+}
+
+func (t *keyValueOptions) String() string {
+	return fmt.Sprintf("String: %v", t.Value)
+}
+
+// Set parses a value of the form KEY=VALUE
+func (t *keyValueOptions) Set(v string) error {
+	r, _ := regexp.Compile(`^([^=]+)=(.*)$`)
+	matches := r.FindStringSubmatch(v)
+	if len(matches) == 0 {
+		return errors.New(fmt.Sprintf("invalid format %s", v))
+	}
+
+	t.Value = append(t.Value, &keyValue{
+		Key:   matches[1],
+		Value: matches[2],
+	})
+
+	return nil
+}
+
+func (t *keyValueOptions) Type() string {
+	return "keyValue"
+}
+
+//
+// placementConstraintOptions
+//
+
+type placementConstraintOptions struct {
+	Value []*ecs.PlacementConstraint
+}
+
+func (t *placementConstraintOptions) String() string {
+	return fmt.Sprintf("String: %v", t.Value)
+}
+
+// Set parses a value of the form distinctInstance or memberOf:EXPRESSION
+func (t *placementConstraintOptions) Set(v string) error {
+	if v == ecs.PlacementConstraintTypeDistinctInstance {
+		t.Value = append(t.Value, &ecs.PlacementConstraint{
+			Type: aws.String(ecs.PlacementConstraintTypeDistinctInstance),
+		})
+		return nil
+	}
+
+	if !strings.HasPrefix(v, ecs.PlacementConstraintTypeMemberOf+":") {
+		return errors.New(fmt.Sprintf("invalid format %s", v))
+	}
+
+	expression := strings.TrimSpace(strings.TrimPrefix(v, ecs.PlacementConstraintTypeMemberOf+":"))
+	err := validateClusterQuery(expression)
+	if err != nil {
+		return err
+	}
+
+	t.Value = append(t.Value, &ecs.PlacementConstraint{
+		Type:       aws.String(ecs.PlacementConstraintTypeMemberOf),
+		Expression: aws.String(expression),
+	})
+
+	return nil
+}
+
+func (t *placementConstraintOptions) Type() string {
+	return "placementConstraint"
+}
+
+// validateClusterQuery checks the syntax of an expression of the cluster query language,
+// e.g. attribute:ecs.availability-zone == us-east-1a and not(ec2InstanceId in ['i-1'])
+func validateClusterQuery(expression string) error {
+	depth := 0
+	for _, c := range expression {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	if depth != 0 {
+		return errors.New(fmt.Sprintf("unbalanced parentheses in expression %s", expression))
+	}
+
+	re, _ := regexp.Compile(`^[a-zA-Z][a-zA-Z0-9_.:-]*\s+(==|!=|>=|<=|>|<|=~|!~|in|not_in|exists|not_exists)(\s+\S.*)?$`)
+	sep, _ := regexp.Compile(`\s+(?:and|or|&&|\|\|)\s+`)
+	for _, term := range sep.Split(expression, -1) {
+		term = strings.Trim(term, "() ")
+		term = strings.TrimPrefix(strings.TrimPrefix(term, "not"), "!")
+		term = strings.Trim(term, "() ")
+		if !re.MatchString(term) {
+			return errors.New(fmt.Sprintf("invalid expression %s", expression))
+		}
+	}
+
+	return nil
+}
+
+//
+// placementStrategyOptions
+//
+
+type placementStrategyOptions struct {
+	Value []*ecs.PlacementStrategy
+}
+
+func (t *placementStrategyOptions) String() string {
+	return fmt.Sprintf("String: %v", t.Value)
+}
+
+// Set parses a value of the form TYPE[:FIELD], e.g. spread:attribute:ecs.availability-zone or binpack:memory
+func (t *placementStrategyOptions) Set(v string) error {
+	r, _ := regexp.Compile(`^(random|spread|binpack)(?::(.+))?$`)
+	matches := r.FindStringSubmatch(v)
+	if len(matches) == 0 {
+		return errors.New(fmt.Sprintf("invalid format %s", v))
+	}
+
+	strategyType, field := matches[1], matches[2]
+	switch strategyType {
+	case ecs.PlacementStrategyTypeRandom:
+		if field != "" {
+			return errors.New(fmt.Sprintf("random does not take a field: %s", v))
+		}
+	case ecs.PlacementStrategyTypeSpread:
+		if field == "" {
+			return errors.New(fmt.Sprintf("spread requires a field: %s", v))
+		}
+	case ecs.PlacementStrategyTypeBinpack:
+		if field != "cpu" && field != "memory" {
+			return errors.New(fmt.Sprintf("binpack requires cpu or memory: %s", v))
+		}
+	}
+
+	item := &ecs.PlacementStrategy{
+		Type: aws.String(strategyType),
+	}
+	if field != "" {
+		item.Field = aws.String(field)
+	}
+
+	t.Value = append(t.Value, item)
+
+	return nil
+}
+
+func (t *placementStrategyOptions) Type() string {
+	return "placementStrategy"
+}
+
+//
+// clusterTargetOptions
+//
+
+type clusterTarget struct {
+	Cluster string
+	Region  string
+}
+
+func (t *clusterTarget) String() string {
+	if t.Region == "" {
+		return t.Cluster
+	}
+	return fmt.Sprintf("%s@%s", t.Cluster, t.Region)
+}
+
+type clusterTargetOptions struct {
+	Value []*clusterTarget
+}
+
+func (t *clusterTargetOptions) String() string {
+	return fmt.Sprintf("String: %v", t.Value)
+}
+
+// Set parses a value of the form CLUSTER[@REGION]
+func (t *clusterTargetOptions) Set(v string) error {
+	r, _ := regexp.Compile(`^([^@]+)(?:@([a-z]{2}(?:-[a-z]+)+-[0-9]+))?$`)
+	matches := r.FindStringSubmatch(v)
+	if len(matches) == 0 {
+		return errors.New(fmt.Sprintf("invalid format %s", v))
+	}
+
+	target := &clusterTarget{
+		Cluster: matches[1],
+		Region:  matches[2],
+	}
+	for _, w := range t.Value {
+		if w.String() == target.String() {
+			return errors.New(fmt.Sprintf("duplicated cluster %s", v))
+		}
+	}
+
+	t.Value = append(t.Value, target)
+
+	return nil
+}
+
+func (t *clusterTargetOptions) Type() string {
+	return "clusterTarget"
+}
+
+//
+// slack webhook URLs
+//
+
+const slackWebhookURLEnv = "SLACK_WEBHOOK_URL"
+
+// resolveSlackWebhookURLs returns the webhook URLs of --slack-webhook-url, or SLACK_WEBHOOK_URL if the flag is empty.
+// a URL of the form ssm://NAME[#FILTER] is read from the SSM parameter NAME
+func resolveSlackWebhookURLs(urls []string, awsOpts *awsOptions) ([]string, error) {
+	if len(urls) == 0 {
+		if v := os.Getenv(slackWebhookURLEnv); v != "" {
+			urls = []string{v}
+		}
+	}
+
+	var client SSMAPI
+	var resolved []string
+	for _, v := range urls {
+		if !strings.HasPrefix(v, "ssm://") {
+			resolved = append(resolved, v)
+			continue
+		}
+
+		if client == nil {
+			c, err := newSSMClient(awsOpts)
+			if err != nil {
+				return nil, err
+			}
+			client = c
+		}
+
+		webhookURL, err := resolveSSMWebhookURL(client, v)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, webhookURL)
+	}
+
+	return resolved, nil
+}
+
+// resolveSSMWebhookURL reads the webhook URL of ssm://NAME[#FILTER] from the SSM parameter NAME.
+// the filter is appended to the URL only if it is given
+func resolveSSMWebhookURL(client SSMAPI, v string) (string, error) {
+	target := log.ParseSlackTarget(v)
+	// ssm://deploy/slack-webhook refers to /deploy/slack-webhook
+	name := strings.TrimPrefix(target.WebhookUrl, "ssm://")
+	if strings.Contains(name, "/") && !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	re, err := client.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to get the slack webhook URL from SSM parameter %s: %s", name, awsutil.WrapError(err).Error()))
+	}
+
+	webhookURL := aws.StringValue(re.Parameter.Value)
+	// ParseSlackTarget removes only a given filter from the value
+	if target.WebhookUrl != v && target.Filter != "" {
+		webhookURL += "#" + target.Filter
+	}
+	return webhookURL, nil
+}
+
+// ecsConsoleURL returns a link to the service in the ECS console of the region
+func ecsConsoleURL(region, cluster, serviceName string) string {
+	return fmt.Sprintf(
+		"https://%s.console.aws.amazon.com/ecs/v2/clusters/%s/services/%s/health?region=%s",
+		region, url.PathEscape(cluster), url.PathEscape(serviceName), region,
+	)
+}
+
+// colorEnabled returns whether to color messages written to w by the mode of --color
+func colorEnabled(mode string, w io.Writer) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		file, ok := w.(*os.File)
+		if !ok {
+			return false, nil
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			return false, nil
+		}
+		return fi.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, errors.New(fmt.Sprintf("invalid --color %s. it must be auto, always or never", mode))
+	}
+}
+
+// pushDeployMetrics pushes the metrics of a deploy or a rollback to the Pushgateway of --pushgateway-url.
+// a failure to push does not fail the command
+func pushDeployMetrics(pushgatewayURL, command, cluster, serviceName string, revision int64, startedAt time.Time, err error, l *log.Logger) {
+	if pushgatewayURL == "" {
+		return
+	}
+
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+
+	perr := metrics.Push(pushgatewayURL, &metrics.Deploy{
+		Command:     command,
+		Cluster:     cluster,
+		ServiceName: serviceName,
+		Revision:    revision,
+		Status:      status,
+		Duration:    time.Since(startedAt),
+	})
+	if perr != nil {
+		l.Log(fmt.Sprintf("warning: failed to push metrics to %s: %s\n", pushgatewayURL, perr.Error()))
+	}
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"github.com/SKAhack/shipctl/lib/awsutil"
+)
+
+// setenv sets the environment variable until the returned function is called. empty value unsets it
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestNewAWSSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config")
+	config := `[profile dev]
+aws_access_key_id = AKIDDEV
+aws_secret_access_key = secret
+
+[profile prod]
+aws_access_key_id = AKIDPROD
+aws_secret_access_key = secret
+`
+	err = ioutil.WriteFile(configFile, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setenv("AWS_CONFIG_FILE", configFile)()
+	defer setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))()
+	defer setenv("AWS_ACCESS_KEY_ID", "")()
+	defer setenv("AWS_SECRET_ACCESS_KEY", "")()
+	defer setenv("AWS_DEFAULT_REGION", "")()
+
+	tests := []struct {
+		name       string
+		opts       awsOptions
+		envProfile string
+		envRegion  string
+		wantKey    string
+		wantRegion string
+	}{
+		{
+			name:       "options",
+			opts:       awsOptions{profile: "dev", region: "ap-northeast-1"},
+			wantKey:    "AKIDDEV",
+			wantRegion: "ap-northeast-1",
+		},
+		{
+			name:       "options take precedence over the environment variables",
+			opts:       awsOptions{profile: "dev", region: "ap-northeast-1"},
+			envProfile: "prod",
+			envRegion:  "us-east-1",
+			wantKey:    "AKIDDEV",
+			wantRegion: "ap-northeast-1",
+		},
+		{
+			name:       "environment variables",
+			envProfile: "prod",
+			envRegion:  "us-east-1",
+			wantKey:    "AKIDPROD",
+			wantRegion: "us-east-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setenv("AWS_PROFILE", tt.envProfile)()
+			defer setenv("AWS_REGION", tt.envRegion)()
+
+			sess, err := newAWSSession(&tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if v := aws.StringValue(sess.Config.Region); v != tt.wantRegion {
+				t.Errorf("region = %s, want %s", v, tt.wantRegion)
+			}
+
+			creds, err := sess.Config.Credentials.Get()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if creds.AccessKeyID != tt.wantKey {
+				t.Errorf("access key of the profile = %s, want %s", creds.AccessKeyID, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestExitCodeOf(t *testing.T) {
+	aerr := awserr.New("AccessDeniedException", "not authorized", nil)
+
+	// an error of ECR is wrapped with the image
+	ecrErr := func() error {
+		client := &fakeECR{
+			batchGetImage: func(in *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+				return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageId: &ecr.ImageIdentifier{}, ImageManifest: aws.String("{}")}}}, nil
+			},
+			putImage: func(in *ecr.PutImageInput) (*ecr.PutImageOutput, error) {
+				return nil, awserr.NewRequestFailure(aerr, 400, "req-1")
+			},
+		}
+		_, err := (&deployCmd{}).tagDockerImage(context.Background(), client, "foo", "v1", "release-1")
+		return err
+	}()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "nil", err: nil, want: ExitCodeSuccess},
+		{name: "error", err: errors.New("invalid flag"), want: ExitCodeError},
+		{name: "exit error", err: &ExitError{Code: 5}, want: 5},
+		{name: "deploy failure", err: newDeployFailure(errors.New("timed out")), want: ExitCodeDeployFailure},
+		{name: "wrapped deploy failure", err: fmt.Errorf("cluster foo: %w", newDeployFailure(errors.New("timed out"))), want: ExitCodeDeployFailure},
+		{name: "rollback failure", err: &rollbackFailure{err: aerr}, want: ExitCodeRollbackFailure},
+		{name: "wrapped rollback failure", err: fmt.Errorf("cluster foo: %w", &rollbackFailure{err: aerr}), want: ExitCodeRollbackFailure},
+		{name: "AWS error", err: awsutil.WrapError(aerr), want: ExitCodeAWSError},
+		{name: "AWS error of waiting", err: newDeployFailure(aerr), want: ExitCodeAWSError},
+		{name: "wrapped AWS error", err: fmt.Errorf("unable to resolve AWS credentials: %w", aerr), want: ExitCodeAWSError},
+		{name: "ECR error", err: ecrErr, want: ExitCodeAWSError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCodeOf(tt.err); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCredentialsExitCode(t *testing.T) {
+	// empty static credentials fail to sign the request without sending it
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("ap-northeast-1"),
+		Credentials: credentials.NewStaticCredentials("", "", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkCredentials(context.Background(), sess, &aws.Config{}, testLogger())
+	if err == nil {
+		t.Fatal("no error is returned")
+	}
+	if got := ExitCodeOf(err); got != ExitCodeAWSError {
+		t.Errorf("exit code = %d, want %d: %s", got, ExitCodeAWSError, err)
+	}
+}
+
+func TestResolveSSMWebhookURL(t *testing.T) {
+	client := newFakeSSM()
+	client.parameters["/deploy/slack-webhook"] = &ssm.Parameter{
+		Type:  aws.String(ssm.ParameterTypeSecureString),
+		Value: aws.String("https://hooks.slack.com/services/xxx"),
+	}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "ssm://deploy/slack-webhook", want: "https://hooks.slack.com/services/xxx"},
+		{value: "ssm:///deploy/slack-webhook", want: "https://hooks.slack.com/services/xxx"},
+		{value: "ssm://deploy/slack-webhook#failure", want: "https://hooks.slack.com/services/xxx#failure"},
+		{value: "ssm://deploy/slack-webhook#all", want: "https://hooks.slack.com/services/xxx#all"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := resolveSSMWebhookURL(client, tt.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("URL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	_, err := resolveSSMWebhookURL(client, "ssm://deploy/missing")
+	if err == nil {
+		t.Errorf("no error is returned for a missing parameter")
+	}
+}
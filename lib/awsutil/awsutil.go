@@ -0,0 +1,48 @@
+package awsutil
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// awsError implements awserr.Error with a message which includes the error code
+type awsError struct {
+	err awserr.Error
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("%s: %s", e.err.Code(), e.err.Message())
+}
+
+func (e *awsError) Code() string    { return e.err.Code() }
+func (e *awsError) Message() string { return e.err.Message() }
+func (e *awsError) OrigErr() error  { return e.err.OrigErr() }
+
+// requestFailure implements awserr.RequestFailure with a message which includes the request ID
+type requestFailure struct {
+	awsError
+	err awserr.RequestFailure
+}
+
+func (e *requestFailure) Error() string {
+	return fmt.Sprintf("%s: %s (status code: %d, request id: %s)", e.err.Code(), e.err.Message(), e.err.StatusCode(), e.err.RequestID())
+}
+
+func (e *requestFailure) StatusCode() int   { return e.err.StatusCode() }
+func (e *requestFailure) RequestID() string { return e.err.RequestID() }
+
+// WrapError returns an error whose message includes the error code, the message and the request ID
+// of an AWS error, which are needed to open a support case.
+// the returned error still implements awserr.Error, so that the code can be checked.
+func WrapError(err error) error {
+	switch v := err.(type) {
+	case nil:
+		return nil
+	case awserr.RequestFailure:
+		return &requestFailure{awsError{v}, v}
+	case awserr.Error:
+		return &awsError{v}
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package codedeploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+// CodeDeployAPI is the subset of the CodeDeploy client used by shipctl, so that a fake can be injected
+type CodeDeployAPI interface {
+	CreateDeploymentWithContext(aws.Context, *codedeploy.CreateDeploymentInput, ...request.Option) (*codedeploy.CreateDeploymentOutput, error)
+	GetDeploymentWithContext(aws.Context, *codedeploy.GetDeploymentInput, ...request.Option) (*codedeploy.GetDeploymentOutput, error)
+}
+
+type appSpec struct {
+	Version   string             `json:"version"`
+	Resources []*appSpecResource `json:"Resources"`
+}
+
+type appSpecResource struct {
+	TargetService *appSpecTargetService `json:"TargetService"`
+}
+
+type appSpecTargetService struct {
+	Type       string            `json:"Type"`
+	Properties appSpecProperties `json:"Properties"`
+}
+
+type appSpecProperties struct {
+	TaskDefinition   string                  `json:"TaskDefinition"`
+	LoadBalancerInfo appSpecLoadBalancerInfo `json:"LoadBalancerInfo"`
+}
+
+type appSpecLoadBalancerInfo struct {
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int64  `json:"ContainerPort"`
+}
+
+// AppSpec returns an AppSpec of the ECS service which replaces the task definition
+func AppSpec(service *ecs.Service, taskDef *ecs.TaskDefinition) (string, error) {
+	if len(service.LoadBalancers) == 0 {
+		return "", errors.New(fmt.Sprintf("%s has no load balancer for blue/green deployment", aws.StringValue(service.ServiceName)))
+	}
+	lb := service.LoadBalancers[0]
+
+	spec := &appSpec{
+		Version: "0.0",
+		Resources: []*appSpecResource{
+			{
+				TargetService: &appSpecTargetService{
+					Type: "AWS::ECS::Service",
+					Properties: appSpecProperties{
+						TaskDefinition: aws.StringValue(taskDef.TaskDefinitionArn),
+						LoadBalancerInfo: appSpecLoadBalancerInfo{
+							ContainerName: aws.StringValue(lb.ContainerName),
+							ContainerPort: aws.Int64Value(lb.ContainerPort),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// CreateDeployment creates a blue/green deployment of the task definition, and returns the deployment ID
+func CreateDeployment(ctx context.Context, client CodeDeployAPI, application, deploymentGroup string, service *ecs.Service, taskDef *ecs.TaskDefinition) (string, error) {
+	content, err := AppSpec(service, taskDef)
+	if err != nil {
+		return "", err
+	}
+
+	params := &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String(application),
+		DeploymentGroupName: aws.String(deploymentGroup),
+		Revision: &codedeploy.RevisionLocation{
+			RevisionType: aws.String(codedeploy.RevisionLocationTypeAppSpecContent),
+			AppSpecContent: &codedeploy.AppSpecContent{
+				Content: aws.String(content),
+			},
+		},
+	}
+
+	res, err := client.CreateDeploymentWithContext(ctx, params)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(res.DeploymentId), nil
+}
+
+func WaitDeployment(ctx context.Context, client CodeDeployAPI, deploymentID string, l *log.Logger) error {
+	start := time.Now()
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			res, err := client.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{
+				DeploymentId: aws.String(deploymentID),
+			})
+			if err != nil {
+				return err
+			}
+
+			d := res.DeploymentInfo
+			status := aws.StringValue(d.Status)
+			switch status {
+			case codedeploy.DeploymentStatusSucceeded:
+				return nil
+			case codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+				reason := ""
+				if d.ErrorInformation != nil {
+					reason = aws.StringValue(d.ErrorInformation.Message)
+				}
+				return errors.New(fmt.Sprintf("deployment %s is %s: %s", deploymentID, status, reason))
+			}
+
+			elapsed := time.Now().Sub(start)
+			l.Progress(fmt.Sprintf("still deploying... %s [%s]\n", status, (elapsed/time.Second)*time.Second))
+		}
+	}
+}
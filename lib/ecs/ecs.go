@@ -1,48 +1,204 @@
 package ecs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecs"
 
+	"github.com/SKAhack/shipctl/lib/awsutil"
 	log "github.com/SKAhack/shipctl/lib/logger"
 )
 
-func DescribeService(client *ecs.ECS, cluster, serviceName string) (*ecs.Service, error) {
+// ECSAPI is the subset of the ECS client used by shipctl, so that a fake can be injected
+type ECSAPI interface {
+	DescribeServicesWithContext(aws.Context, *ecs.DescribeServicesInput, ...request.Option) (*ecs.DescribeServicesOutput, error)
+	DescribeTaskDefinitionWithContext(aws.Context, *ecs.DescribeTaskDefinitionInput, ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error)
+	RegisterTaskDefinitionWithContext(aws.Context, *ecs.RegisterTaskDefinitionInput, ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error)
+	UpdateServiceWithContext(aws.Context, *ecs.UpdateServiceInput, ...request.Option) (*ecs.UpdateServiceOutput, error)
+	CreateServiceWithContext(aws.Context, *ecs.CreateServiceInput, ...request.Option) (*ecs.CreateServiceOutput, error)
+	ListTaskDefinitionsPagesWithContext(aws.Context, *ecs.ListTaskDefinitionsInput, func(*ecs.ListTaskDefinitionsOutput, bool) bool, ...request.Option) error
+	DeregisterTaskDefinitionWithContext(aws.Context, *ecs.DeregisterTaskDefinitionInput, ...request.Option) (*ecs.DeregisterTaskDefinitionOutput, error)
+	ListTasksWithContext(aws.Context, *ecs.ListTasksInput, ...request.Option) (*ecs.ListTasksOutput, error)
+	ListClustersWithContext(aws.Context, *ecs.ListClustersInput, ...request.Option) (*ecs.ListClustersOutput, error)
+	ListServicesWithContext(aws.Context, *ecs.ListServicesInput, ...request.Option) (*ecs.ListServicesOutput, error)
+	ExecuteCommandWithContext(aws.Context, *ecs.ExecuteCommandInput, ...request.Option) (*ecs.ExecuteCommandOutput, error)
+	RunTaskWithContext(aws.Context, *ecs.RunTaskInput, ...request.Option) (*ecs.RunTaskOutput, error)
+	DescribeTasksWithContext(aws.Context, *ecs.DescribeTasksInput, ...request.Option) (*ecs.DescribeTasksOutput, error)
+	StopTaskWithContext(aws.Context, *ecs.StopTaskInput, ...request.Option) (*ecs.StopTaskOutput, error)
+}
+
+// ErrServiceNotFound is returned by DescribeService if the service does not exist or is deleted
+var ErrServiceNotFound = errors.New("service is not found")
+
+func DescribeService(ctx context.Context, client ECSAPI, cluster, serviceName string) (*ecs.Service, error) {
 	params := &ecs.DescribeServicesInput{
 		Services: []*string{aws.String(serviceName)},
 		Cluster:  aws.String(cluster),
 	}
 
-	res, err := client.DescribeServices(params)
+	res, err := client.DescribeServicesWithContext(ctx, params)
 	if err != nil {
-		return nil, err
+		return nil, awsutil.WrapError(err)
 	}
 
-	if len(res.Services) == 0 {
-		return nil, errors.New("service is not found")
+	if len(res.Services) == 0 || aws.StringValue(res.Services[0].Status) == "INACTIVE" {
+		return nil, ErrServiceNotFound
 	}
 
 	return res.Services[0], nil
 }
 
-func DescribeTaskDefinition(client *ecs.ECS, arn string) (*ecs.TaskDefinition, error) {
+func DescribeTaskDefinition(ctx context.Context, client ECSAPI, arn string) (*ecs.TaskDefinition, error) {
 	params := &ecs.DescribeTaskDefinitionInput{
 		TaskDefinition: aws.String(arn),
 	}
 
-	res, err := client.DescribeTaskDefinition(params)
+	res, err := client.DescribeTaskDefinitionWithContext(ctx, params)
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+
+	return res.TaskDefinition, nil
+}
+
+// ListClusterNames returns names of the clusters in the region, up to 100
+func ListClusterNames(ctx context.Context, client ECSAPI) ([]string, error) {
+	res, err := client.ListClustersWithContext(ctx, &ecs.ListClustersInput{})
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+
+	var names []string
+	for _, v := range res.ClusterArns {
+		name, err := ClusterNameOf(aws.StringValue(v))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// ListServiceNames returns names of the services in the cluster, up to 100
+func ListServiceNames(ctx context.Context, client ECSAPI, cluster string) ([]string, error) {
+	res, err := client.ListServicesWithContext(ctx, &ecs.ListServicesInput{
+		Cluster:    aws.String(cluster),
+		MaxResults: aws.Int64(100),
+	})
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+
+	var names []string
+	for _, v := range res.ServiceArns {
+		name, err := ServiceNameOf(cluster, aws.StringValue(v))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// ListTaskDefinitions returns ARNs of the task definitions in the family, newest first
+func ListTaskDefinitions(ctx context.Context, client ECSAPI, family, status string) ([]string, error) {
+	params := &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Sort:         aws.String(ecs.SortOrderDesc),
+	}
+	if status != "" {
+		params.Status = aws.String(status)
+	}
+
+	re, err := regexp.Compile(`:task-definition/(.+):[1-9][0-9]*$`)
 	if err != nil {
 		return nil, err
 	}
 
+	var arns []string
+	err = client.ListTaskDefinitionsPagesWithContext(ctx, params, func(page *ecs.ListTaskDefinitionsOutput, lastPage bool) bool {
+		for _, v := range page.TaskDefinitionArns {
+			// FamilyPrefix also matches other families which start with the same name
+			matches := re.FindStringSubmatch(*v)
+			if len(matches) > 0 && matches[1] == family {
+				arns = append(arns, *v)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+
+	return arns, nil
+}
+
+// DescribeTaskDefinitionTags returns the tags of the task definition, which DescribeTaskDefinition does not include
+func DescribeTaskDefinitionTags(ctx context.Context, client ECSAPI, arn string) ([]*ecs.Tag, error) {
+	params := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(arn),
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
+	}
+
+	res, err := client.DescribeTaskDefinitionWithContext(ctx, params)
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+
+	return res.Tags, nil
+}
+
+// RegisterTaskDefinition registers the task definition with the tags. tags can be nil
+func RegisterTaskDefinition(ctx context.Context, client ECSAPI, taskDef *ecs.TaskDefinition, tags []*ecs.Tag) (*ecs.TaskDefinition, error) {
+	params := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDef.ContainerDefinitions,
+		Cpu:                     taskDef.Cpu,
+		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
+		Family:                  taskDef.Family,
+		Memory:                  taskDef.Memory,
+		NetworkMode:             taskDef.NetworkMode,
+		PlacementConstraints:    taskDef.PlacementConstraints,
+		TaskRoleArn:             taskDef.TaskRoleArn,
+		Volumes:                 taskDef.Volumes,
+		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+	}
+	if len(tags) > 0 {
+		params.Tags = tags
+	}
+
+	res, err := client.RegisterTaskDefinitionWithContext(ctx, params)
+	if err != nil {
+		return nil, awsutil.WrapError(err)
+	}
+
 	return res.TaskDefinition, nil
 }
 
+func DeregisterTaskDefinition(ctx context.Context, client ECSAPI, arn string) error {
+	params := &ecs.DeregisterTaskDefinitionInput{
+		TaskDefinition: aws.String(arn),
+	}
+
+	_, err := client.DeregisterTaskDefinitionWithContext(ctx, params)
+	if err != nil {
+		return awsutil.WrapError(err)
+	}
+
+	return nil
+}
+
 func SpecifyRevision(revision int, arn string) (string, error) {
 	if revision <= 0 {
 		return arn, nil
@@ -56,7 +212,151 @@ func SpecifyRevision(revision int, arn string) (string, error) {
 	return re.ReplaceAllString(arn, fmt.Sprintf("${1}:%d", revision)), nil
 }
 
-func UpdateService(client *ecs.ECS, service *ecs.Service, taskDef *ecs.TaskDefinition) error {
+func RevisionOf(arn string) (int, error) {
+	re, err := regexp.Compile(`:([1-9][0-9]*)$`)
+	if err != nil {
+		return 0, err
+	}
+
+	matches := re.FindStringSubmatch(arn)
+	if len(matches) == 0 {
+		return 0, errors.New(fmt.Sprintf("revision is not found in %s", arn))
+	}
+
+	return strconv.Atoi(matches[1])
+}
+
+// ClusterNameOf returns the cluster name from a cluster name or ARN
+func ClusterNameOf(v string) (string, error) {
+	if !arn.IsARN(v) {
+		return v, nil
+	}
+
+	a, err := arn.Parse(v)
+	if err != nil {
+		return "", err
+	}
+
+	if a.Service != "ecs" || !strings.HasPrefix(a.Resource, "cluster/") {
+		return "", errors.New(fmt.Sprintf("%s is not an ARN of ECS cluster", v))
+	}
+
+	return strings.TrimPrefix(a.Resource, "cluster/"), nil
+}
+
+// ServiceNameOf returns the service name from a service name or ARN.
+// a service ARN which contains a cluster name must belong to the cluster
+func ServiceNameOf(cluster, v string) (string, error) {
+	if !arn.IsARN(v) {
+		return v, nil
+	}
+
+	a, err := arn.Parse(v)
+	if err != nil {
+		return "", err
+	}
+
+	if a.Service != "ecs" || !strings.HasPrefix(a.Resource, "service/") {
+		return "", errors.New(fmt.Sprintf("%s is not an ARN of ECS service", v))
+	}
+
+	parts := strings.Split(strings.TrimPrefix(a.Resource, "service/"), "/")
+	switch len(parts) {
+	case 1:
+		// the old ARN format does not contain the cluster name
+		return parts[0], nil
+	case 2:
+		if parts[0] != cluster {
+			return "", errors.New(fmt.Sprintf("service %s does not belong to cluster %s", v, cluster))
+		}
+		return parts[1], nil
+	default:
+		return "", errors.New(fmt.Sprintf("%s is not an ARN of ECS service", v))
+	}
+}
+
+type CreateServiceOptions struct {
+	DesiredCount             int64
+	LaunchType               string
+	CapacityProviderStrategy []*ecs.CapacityProviderStrategyItem
+	// Subnets, SecurityGroups and AssignPublicIP are the awsvpc network configuration, which is set if Subnets is not empty
+	Subnets              []string
+	SecurityGroups       []string
+	AssignPublicIP       string
+	PropagateTags        string
+	EnableECSManagedTags bool
+	// PlatformVersion is the Fargate platform version, e.g. 1.4.0
+	PlatformVersion string
+	// MaximumPercent and MinimumHealthyPercent are the defaults of ECS if they are nil
+	MaximumPercent        *int64
+	MinimumHealthyPercent *int64
+}
+
+func CreateService(ctx context.Context, client ECSAPI, cluster, serviceName string, taskDef *ecs.TaskDefinition, opts *CreateServiceOptions) error {
+	params := &ecs.CreateServiceInput{
+		Cluster:        aws.String(cluster),
+		ServiceName:    aws.String(serviceName),
+		TaskDefinition: taskDef.TaskDefinitionArn,
+		DesiredCount:   aws.Int64(opts.DesiredCount),
+	}
+
+	if opts.LaunchType != "" {
+		params.LaunchType = aws.String(opts.LaunchType)
+	}
+	if len(opts.CapacityProviderStrategy) > 0 {
+		params.CapacityProviderStrategy = opts.CapacityProviderStrategy
+	}
+	if len(opts.Subnets) > 0 {
+		config := &ecs.AwsVpcConfiguration{
+			Subnets:        aws.StringSlice(opts.Subnets),
+			SecurityGroups: aws.StringSlice(opts.SecurityGroups),
+		}
+		if opts.AssignPublicIP != "" {
+			config.AssignPublicIp = aws.String(opts.AssignPublicIP)
+		}
+		params.NetworkConfiguration = &ecs.NetworkConfiguration{
+			AwsvpcConfiguration: config,
+		}
+	}
+	if opts.PropagateTags != "" {
+		params.PropagateTags = aws.String(opts.PropagateTags)
+	}
+	if opts.EnableECSManagedTags {
+		params.EnableECSManagedTags = aws.Bool(true)
+	}
+	if opts.PlatformVersion != "" {
+		params.PlatformVersion = aws.String(opts.PlatformVersion)
+	}
+	if opts.MaximumPercent != nil || opts.MinimumHealthyPercent != nil {
+		params.DeploymentConfiguration = &ecs.DeploymentConfiguration{
+			MaximumPercent:        opts.MaximumPercent,
+			MinimumHealthyPercent: opts.MinimumHealthyPercent,
+		}
+	}
+
+	_, err := client.CreateServiceWithContext(ctx, params)
+	if err != nil {
+		return awsutil.WrapError(err)
+	}
+
+	return nil
+}
+
+type UpdateServiceOptions struct {
+	CapacityProviderStrategy []*ecs.CapacityProviderStrategyItem
+	PropagateTags            string
+	EnableECSManagedTags     bool
+	ForceNewDeployment       bool
+	// PlatformVersion is the Fargate platform version, e.g. 1.4.0
+	PlatformVersion string
+	// DesiredCount overrides the desired count of the service if it is positive
+	DesiredCount int64
+	// MaximumPercent and MinimumHealthyPercent override the deployment configuration if they are not nil
+	MaximumPercent        *int64
+	MinimumHealthyPercent *int64
+}
+
+func UpdateService(ctx context.Context, client ECSAPI, service *ecs.Service, taskDef *ecs.TaskDefinition, opts *UpdateServiceOptions) error {
 	params := &ecs.UpdateServiceInput{
 		Cluster:                 service.ClusterArn,
 		DeploymentConfiguration: service.DeploymentConfiguration,
@@ -65,31 +365,191 @@ func UpdateService(client *ecs.ECS, service *ecs.Service, taskDef *ecs.TaskDefin
 		TaskDefinition:          taskDef.TaskDefinitionArn,
 	}
 
-	_, err := client.UpdateService(params)
-	if err != nil {
-		return err
+	if opts != nil {
+		if len(opts.CapacityProviderStrategy) > 0 {
+			params.CapacityProviderStrategy = opts.CapacityProviderStrategy
+		}
+		if opts.PropagateTags != "" {
+			params.PropagateTags = aws.String(opts.PropagateTags)
+		}
+		if opts.EnableECSManagedTags {
+			params.EnableECSManagedTags = aws.Bool(true)
+		}
+		if opts.ForceNewDeployment {
+			params.ForceNewDeployment = aws.Bool(true)
+		}
+		if opts.PlatformVersion != "" {
+			params.PlatformVersion = aws.String(opts.PlatformVersion)
+		}
+		if opts.DesiredCount > 0 {
+			params.DesiredCount = aws.Int64(opts.DesiredCount)
+		}
+		if opts.MaximumPercent != nil || opts.MinimumHealthyPercent != nil {
+			// unset values are kept as the service's
+			config := &ecs.DeploymentConfiguration{}
+			if service.DeploymentConfiguration != nil {
+				*config = *service.DeploymentConfiguration // shallow copy
+			}
+			if opts.MaximumPercent != nil {
+				config.MaximumPercent = opts.MaximumPercent
+			}
+			if opts.MinimumHealthyPercent != nil {
+				config.MinimumHealthyPercent = opts.MinimumHealthyPercent
+			}
+			params.DeploymentConfiguration = config
+		}
 	}
 
-	return nil
+	// a task definition just registered may not be visible yet, so not found errors are retried with backoff
+	backoff := UpdateServiceBackoff
+	for i := 1; ; i++ {
+		_, err := client.UpdateServiceWithContext(ctx, params)
+		if err == nil {
+			return nil
+		}
+
+		if !isTaskDefinitionNotFound(err) {
+			return awsutil.WrapError(err)
+		}
+
+		if i >= updateServiceMaxAttempts {
+			return errors.New(fmt.Sprintf("task definition %s is not found after %d attempts: %s", aws.StringValue(params.TaskDefinition), i, awsutil.WrapError(err).Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+const updateServiceMaxAttempts = 5
+
+// UpdateServiceBackoff is the first interval of retrying UpdateService, which is doubled by each attempt
+var UpdateServiceBackoff = time.Second
+
+// isTaskDefinitionNotFound reports whether err means the task definition is not visible to UpdateService yet
+func isTaskDefinitionNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case ecs.ErrCodeClientException, ecs.ErrCodeInvalidParameterException:
+		msg := strings.ToLower(aerr.Message())
+		return strings.Contains(msg, "taskdefinition not found") || strings.Contains(msg, "unable to describe task definition")
+	}
+
+	return false
 }
 
-func WaitUpdateService(client *ecs.ECS, cluster, serviceName string, l *log.Logger) error {
+// WaitInterval is the interval of describing the service in WaitUpdateService
+var WaitInterval = 10 * time.Second
+
+// WaitUpdateService waits until the running count reaches the desired count.
+// with steadyState, it also waits until the previous deployment is drained and the rollout is completed,
+// since the counts can be equal in the middle of a rollout which allows over-provisioning
+func WaitUpdateService(ctx context.Context, client ECSAPI, cluster, serviceName string, steadyState bool, l *log.Logger) error {
 	start := time.Now()
-	t := time.NewTicker(10 * time.Second)
+	lastEventID := ""
+	t := time.NewTicker(WaitInterval)
+	defer t.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			// ctx is cancelled by SIGINT or SIGTERM, e.g. Ctrl-C
+			l.Log("interrupted. the rollout continues in ECS, but is not finalized by shipctl\n")
+			return errors.New(fmt.Sprintf("waiting for service %s was cancelled: %s", serviceName, ctx.Err().Error()))
 		case <-t.C:
-			s, err := DescribeService(client, cluster, serviceName)
+			s, err := DescribeService(ctx, client, cluster, serviceName)
 			if err != nil {
 				return err
 			}
 
+			var events []*ecs.ServiceEvent
+			events, lastEventID = newServiceEvents(s, lastEventID, start)
+			for _, e := range events {
+				l.Log(fmt.Sprintf("event: %s %s\n", e.CreatedAt.Format(time.RFC3339), aws.StringValue(e.Message)))
+			}
+
 			elapsed := time.Now().Sub(start)
-			l.Log(fmt.Sprintf("still service updating... [%s]\n", (elapsed/time.Second)*time.Second))
+			l.Progress(fmt.Sprintf("still service updating... [%s]\n", (elapsed/time.Second)*time.Second))
+
+			primary := primaryDeployment(s)
+			if primary != nil && aws.StringValue(primary.RolloutState) == ecs.DeploymentRolloutStateFailed {
+				return errors.New(fmt.Sprintf("deployment %s failed: %s", aws.StringValue(primary.Id), aws.StringValue(primary.RolloutStateReason)))
+			}
 
-			if len(s.Deployments) == 1 && *s.RunningCount == *s.DesiredCount {
+			if s.RunningCount == nil || s.DesiredCount == nil {
+				// counts can be missing while the service is transitioning, so it is not stable yet
+				l.Debug(fmt.Sprintf("running or desired count of %s is missing. keep waiting\n", serviceName))
+				continue
+			}
+
+			if *s.RunningCount != *s.DesiredCount {
+				continue
+			}
+			if !steadyState || (len(s.Deployments) == 1 && isSteady(s, primary)) {
 				return nil
 			}
 		}
 	}
 }
+
+// newServiceEvents returns events after lastEventID, or after since if no event is seen yet, oldest first.
+// it also returns the ID of the latest event
+func newServiceEvents(s *ecs.Service, lastEventID string, since time.Time) ([]*ecs.ServiceEvent, string) {
+	var events []*ecs.ServiceEvent
+	// service events are sorted newest first
+	for _, e := range s.Events {
+		if aws.StringValue(e.Id) == lastEventID {
+			break
+		}
+		if e.CreatedAt == nil || e.CreatedAt.Before(since) {
+			break
+		}
+		events = append([]*ecs.ServiceEvent{e}, events...)
+	}
+
+	if len(s.Events) > 0 {
+		lastEventID = aws.StringValue(s.Events[0].Id)
+	}
+
+	return events, lastEventID
+}
+
+func primaryDeployment(s *ecs.Service) *ecs.Deployment {
+	for _, d := range s.Deployments {
+		if aws.StringValue(d.Status) == "PRIMARY" {
+			return d
+		}
+	}
+	return nil
+}
+
+// isSteady reports whether ECS considers the deployment stable.
+// rolloutState is only set for the ECS deployment controller,
+// so it falls back to the steady state event after the deployment is created
+func isSteady(s *ecs.Service, d *ecs.Deployment) bool {
+	if d == nil {
+		return false
+	}
+
+	if d.RolloutState != nil {
+		return aws.StringValue(d.RolloutState) == ecs.DeploymentRolloutStateCompleted
+	}
+
+	for _, e := range s.Events {
+		if e.CreatedAt == nil || d.CreatedAt == nil || e.CreatedAt.Before(*d.CreatedAt) {
+			continue
+		}
+		if strings.Contains(aws.StringValue(e.Message), "has reached a steady state") {
+			return true
+		}
+	}
+
+	return false
+}
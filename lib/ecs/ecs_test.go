@@ -0,0 +1,318 @@
+package ecs
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+// fakeECS implements ECSAPI by the functions set by a test.
+// methods which are not overridden panic with the nil embedded interface
+type fakeECS struct {
+	ECSAPI
+
+	describeServices func(*ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error)
+	updateService    func(*ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error)
+	// err is returned by the other methods below
+	err error
+}
+
+func (c *fakeECS) DescribeTaskDefinitionWithContext(aws.Context, *ecs.DescribeTaskDefinitionInput, ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return nil, c.err
+}
+
+func (c *fakeECS) DeregisterTaskDefinitionWithContext(aws.Context, *ecs.DeregisterTaskDefinitionInput, ...request.Option) (*ecs.DeregisterTaskDefinitionOutput, error) {
+	return nil, c.err
+}
+
+func (c *fakeECS) ListTaskDefinitionsPagesWithContext(aws.Context, *ecs.ListTaskDefinitionsInput, func(*ecs.ListTaskDefinitionsOutput, bool) bool, ...request.Option) error {
+	return c.err
+}
+
+func (c *fakeECS) DescribeServicesWithContext(_ aws.Context, in *ecs.DescribeServicesInput, _ ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	return c.describeServices(in)
+}
+
+func (c *fakeECS) UpdateServiceWithContext(_ aws.Context, in *ecs.UpdateServiceInput, _ ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	return c.updateService(in)
+}
+
+func testLogger() *log.Logger {
+	return log.NewLogger("foo", "bar", nil, ioutil.Discard, ioutil.Discard)
+}
+
+func testService() *ecs.Service {
+	return &ecs.Service{
+		ClusterArn:   aws.String("arn:aws:ecs:ap-northeast-1:123456789012:cluster/foo"),
+		ServiceName:  aws.String("bar"),
+		DesiredCount: aws.Int64(3),
+		DeploymentConfiguration: &ecs.DeploymentConfiguration{
+			MaximumPercent:        aws.Int64(200),
+			MinimumHealthyPercent: aws.Int64(100),
+		},
+	}
+}
+
+func testTaskDefinition() *ecs.TaskDefinition {
+	return &ecs.TaskDefinition{
+		TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/bar:2"),
+		Revision:          aws.Int64(2),
+	}
+}
+
+func TestUpdateService(t *testing.T) {
+	tests := []struct {
+		name                  string
+		opts                  *UpdateServiceOptions
+		desiredCount          int64
+		maximumPercent        int64
+		minimumHealthyPercent int64
+		propagateTags         string
+		enableECSManagedTags  bool
+	}{
+		{
+			name:                  "without options",
+			opts:                  nil,
+			desiredCount:          3,
+			maximumPercent:        200,
+			minimumHealthyPercent: 100,
+		},
+		{
+			name:                  "desired count",
+			opts:                  &UpdateServiceOptions{DesiredCount: 1},
+			desiredCount:          1,
+			maximumPercent:        200,
+			minimumHealthyPercent: 100,
+		},
+		{
+			name:                  "maximum percent",
+			opts:                  &UpdateServiceOptions{MaximumPercent: aws.Int64(150)},
+			desiredCount:          3,
+			maximumPercent:        150,
+			minimumHealthyPercent: 100,
+		},
+		{
+			name:                  "tags",
+			opts:                  &UpdateServiceOptions{PropagateTags: ecs.PropagateTagsService, EnableECSManagedTags: true},
+			desiredCount:          3,
+			maximumPercent:        200,
+			minimumHealthyPercent: 100,
+			propagateTags:         ecs.PropagateTagsService,
+			enableECSManagedTags:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			var got *ecs.UpdateServiceInput
+			client := &fakeECS{
+				updateService: func(in *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+					got = in
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+			}
+
+			err := UpdateService(context.Background(), client, service, testTaskDefinition(), tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if v := aws.StringValue(got.TaskDefinition); v != *testTaskDefinition().TaskDefinitionArn {
+				t.Errorf("task definition = %s", v)
+			}
+			if v := aws.Int64Value(got.DesiredCount); v != tt.desiredCount {
+				t.Errorf("desired count = %d, want %d", v, tt.desiredCount)
+			}
+			if v := aws.Int64Value(got.DeploymentConfiguration.MaximumPercent); v != tt.maximumPercent {
+				t.Errorf("maximum percent = %d, want %d", v, tt.maximumPercent)
+			}
+			if v := aws.Int64Value(got.DeploymentConfiguration.MinimumHealthyPercent); v != tt.minimumHealthyPercent {
+				t.Errorf("minimum healthy percent = %d, want %d", v, tt.minimumHealthyPercent)
+			}
+			if v := aws.StringValue(got.PropagateTags); v != tt.propagateTags {
+				t.Errorf("propagate tags = %q, want %q", v, tt.propagateTags)
+			}
+			if v := aws.BoolValue(got.EnableECSManagedTags); v != tt.enableECSManagedTags {
+				t.Errorf("enable ECS managed tags = %t, want %t", v, tt.enableECSManagedTags)
+			}
+
+			// the deployment configuration of the service must not be modified
+			if v := aws.Int64Value(service.DeploymentConfiguration.MaximumPercent); v != 200 {
+				t.Errorf("maximum percent of the service is modified to %d", v)
+			}
+		})
+	}
+}
+
+func TestWaitUpdateServiceMissingCounts(t *testing.T) {
+	defer func(v time.Duration) { WaitInterval = v }(WaitInterval)
+	WaitInterval = time.Millisecond
+
+	stable := testService()
+	stable.RunningCount = aws.Int64(3)
+	stable.Deployments = []*ecs.Deployment{{
+		Status:       aws.String("PRIMARY"),
+		RolloutState: aws.String(ecs.DeploymentRolloutStateCompleted),
+	}}
+
+	tests := []struct {
+		name    string
+		missing func(*ecs.Service)
+	}{
+		{name: "running count", missing: func(s *ecs.Service) { s.RunningCount = nil }},
+		{name: "desired count", missing: func(s *ecs.Service) { s.DesiredCount = nil }},
+		{name: "both", missing: func(s *ecs.Service) { s.RunningCount, s.DesiredCount = nil, nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transitioning := *stable // shallow copy
+			tt.missing(&transitioning)
+
+			// the counts are missing at first, and then the service is stable
+			calls := 0
+			client := &fakeECS{
+				describeServices: func(in *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+					calls++
+					if calls == 1 {
+						return &ecs.DescribeServicesOutput{Services: []*ecs.Service{&transitioning}}, nil
+					}
+					return &ecs.DescribeServicesOutput{Services: []*ecs.Service{stable}}, nil
+				},
+			}
+
+			err := WaitUpdateService(context.Background(), client, "foo", "bar", true, testLogger())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if calls != 2 {
+				t.Errorf("described %d times, want 2", calls)
+			}
+		})
+	}
+}
+
+func TestUpdateServiceRetry(t *testing.T) {
+	defer func(v time.Duration) { UpdateServiceBackoff = v }(UpdateServiceBackoff)
+	UpdateServiceBackoff = time.Millisecond
+
+	notFound := awserr.New(ecs.ErrCodeClientException, "TaskDefinition not found.", nil)
+
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		// wantCalls is the number of UpdateService calls
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "visible at once", failures: 0, err: notFound, wantCalls: 1},
+		{name: "visible late", failures: 3, err: notFound, wantCalls: 4},
+		{name: "visible at the last attempt", failures: 4, err: notFound, wantCalls: 5},
+		{name: "never visible", failures: 10, err: notFound, wantCalls: 5, wantErr: true},
+		{name: "other errors are not retried", failures: 1, err: awserr.New(ecs.ErrCodeAccessDeniedException, "not authorized", nil), wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			client := &fakeECS{
+				updateService: func(in *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+					calls++
+					if calls <= tt.failures {
+						return nil, tt.err
+					}
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+			}
+
+			err := UpdateService(context.Background(), client, testService(), testTaskDefinition(), nil)
+			if tt.wantErr && err == nil {
+				t.Errorf("no error is returned")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("UpdateService is called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestTaskDefinitionErrors(t *testing.T) {
+	client := &fakeECS{
+		err: awserr.NewRequestFailure(awserr.New(ecs.ErrCodeClientException, "Unable to describe task definition.", nil), 400, "req-1"),
+	}
+	want := "ClientException: Unable to describe task definition. (status code: 400, request id: req-1)"
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "DescribeTaskDefinition", call: func() error {
+			_, err := DescribeTaskDefinition(context.Background(), client, "bar:1")
+			return err
+		}},
+		{name: "DeregisterTaskDefinition", call: func() error {
+			return DeregisterTaskDefinition(context.Background(), client, "bar:1")
+		}},
+		{name: "ListTaskDefinitions", call: func() error {
+			_, err := ListTaskDefinitions(context.Background(), client, "bar", "")
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if err == nil || err.Error() != want {
+				t.Fatalf("error = %v, want %s", err, want)
+			}
+			if _, ok := err.(awserr.RequestFailure); !ok {
+				t.Errorf("error does not implement awserr.RequestFailure")
+			}
+		})
+	}
+}
+
+func TestUpdateServiceTagsRoundTrip(t *testing.T) {
+	// the fake service keeps the values of the last update, like ECS does
+	service := testService()
+	client := &fakeECS{
+		updateService: func(in *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+			service.PropagateTags = in.PropagateTags
+			service.EnableECSManagedTags = in.EnableECSManagedTags
+			return &ecs.UpdateServiceOutput{Service: service}, nil
+		},
+		describeServices: func(in *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+			return &ecs.DescribeServicesOutput{Services: []*ecs.Service{service}}, nil
+		},
+	}
+
+	opts := &UpdateServiceOptions{PropagateTags: ecs.PropagateTagsTaskDefinition, EnableECSManagedTags: true}
+	err := UpdateService(context.Background(), client, testService(), testTaskDefinition(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := DescribeService(context.Background(), client, "foo", "bar")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := aws.StringValue(got.PropagateTags); v != ecs.PropagateTagsTaskDefinition {
+		t.Errorf("propagate tags = %q, want TASK_DEFINITION", v)
+	}
+	if !aws.BoolValue(got.EnableECSManagedTags) {
+		t.Errorf("ECS managed tags are not enabled")
+	}
+}
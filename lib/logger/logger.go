@@ -1,58 +1,199 @@
 package logger
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
 	slack "github.com/monochromegane/slack-incoming-webhooks"
 )
 
 type Logger struct {
-	Cluster         string
-	ServiceName     string
-	Out             io.Writer
-	SlackWebhookUrl string
+	Cluster     string
+	ServiceName string
+	// Out is for results of commands, ErrOut is for progress and diagnostics
+	Out          io.Writer
+	ErrOut       io.Writer
+	SlackTargets []*SlackTarget
+	// SlackUsername and SlackChannel override the defaults of the webhook
+	SlackUsername string
+	SlackChannel  string
+	// Prefix is prepended to logs, e.g. the cluster of deploy --cluster-list
+	Prefix string
+	// DeployID is included in slack notifications if it is not empty
+	DeployID string
+	// ConsoleURL is a link to the service in the AWS console, included in slack notifications if it is not empty
+	ConsoleURL string
+	// NotifyOn is the set of events to notify to slack. nil means all events
+	NotifyOn map[string]bool
+	Quiet    bool
+	Verbose  bool
+	// Color colors success and failure messages of Status
+	Color bool
 }
 
-func NewLogger(cluster, serviceName, slackWebhookUrl string, out io.Writer) *Logger {
+// SlackTarget is a webhook URL with a severity filter.
+// The filter is one of "all", "info", "success" or "failure".
+type SlackTarget struct {
+	WebhookUrl string
+	Filter     string
+}
+
+// events maps message types to lifecycle events of --notify-on
+var events = map[string]string{
+	"normal": "start",
+	"good":   "success",
+	"danger": "failure",
+}
+
+// ParseNotifyOn parses a comma-separated list of start, success and failure
+func ParseNotifyOn(v string) (map[string]bool, error) {
+	notifyOn := map[string]bool{}
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		switch e {
+		case "":
+		case "start", "success", "failure":
+			notifyOn[e] = true
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid event %s. it must be start, success or failure", e))
+		}
+	}
+	return notifyOn, nil
+}
+
+var severities = map[string]string{
+	"normal": "info",
+	"good":   "success",
+	"danger": "failure",
+}
+
+// ParseSlackTarget parses a value of the form URL[#FILTER]
+func ParseSlackTarget(v string) *SlackTarget {
+	i := strings.LastIndex(v, "#")
+	if i >= 0 {
+		filter := v[i+1:]
+		if filter == "all" || filter == "info" || filter == "success" || filter == "failure" {
+			return &SlackTarget{WebhookUrl: v[:i], Filter: filter}
+		}
+	}
+	return &SlackTarget{WebhookUrl: v, Filter: "all"}
+}
+
+func (t *SlackTarget) Match(messageType string) bool {
+	return t.Filter == "all" || t.Filter == severities[messageType]
+}
+
+func NewLogger(cluster, serviceName string, slackWebhookUrls []string, out, errOut io.Writer) *Logger {
+	var targets []*SlackTarget
+	for _, v := range slackWebhookUrls {
+		if v == "" {
+			continue
+		}
+		targets = append(targets, ParseSlackTarget(v))
+	}
+
 	return &Logger{
-		Cluster:         cluster,
-		ServiceName:     serviceName,
-		SlackWebhookUrl: slackWebhookUrl,
-		Out:             out,
+		Cluster:       cluster,
+		ServiceName:   serviceName,
+		SlackTargets:  targets,
+		SlackUsername: "deploy-bot",
+		Out:           out,
+		ErrOut:        errOut,
 	}
 }
 
+// Log logs a progress or diagnostic message to ErrOut
 func (l *Logger) Log(message string) {
+	if l.ErrOut != nil {
+		fmt.Fprint(l.ErrOut, l.Prefix+message)
+	}
+}
+
+var colors = map[string]string{
+	"good":   "\x1b[32m",
+	"danger": "\x1b[31m",
+}
+
+// Status logs a success ("good") or failure ("danger") message to ErrOut, in color if Color is set.
+// slack notifications are not colored
+func (l *Logger) Status(messageType string, message string) {
+	color, ok := colors[messageType]
+	if !l.Color || !ok {
+		l.Log(message)
+		return
+	}
+	body := strings.TrimRight(message, "\n")
+	l.Log(color + body + "\x1b[0m" + message[len(body):])
+}
+
+// Result writes a result of the command to Out, e.g. a revision for scripts
+func (l *Logger) Result(message string) {
 	if l.Out != nil {
-		fmt.Fprintf(l.Out, message)
+		fmt.Fprint(l.Out, l.Prefix+message)
+	}
+}
+
+// Debug logs a message with a timestamp in verbose mode
+func (l *Logger) Debug(message string) {
+	if l.Verbose {
+		l.Log(fmt.Sprintf("[%s] %s", time.Now().Format(time.RFC3339), message))
+	}
+}
+
+// Progress logs a periodic progress message, which is suppressed in quiet mode
+func (l *Logger) Progress(message string) {
+	if !l.Quiet {
+		l.Log(message)
 	}
 }
 
 func (l *Logger) Slack(messageType string, message string) {
-	if l.SlackWebhookUrl == "" {
+	if l.NotifyOn != nil && !l.NotifyOn[events[messageType]] {
 		return
 	}
 
+	for _, t := range l.SlackTargets {
+		if t.Match(messageType) {
+			l.postSlack(t.WebhookUrl, messageType, message)
+		}
+	}
+}
+
+func (l *Logger) postSlack(webhookUrl string, messageType string, message string) {
 	switch messageType {
 	case "normal":
-		client := &slack.Client{WebhookURL: l.SlackWebhookUrl}
+		client := &slack.Client{WebhookURL: webhookUrl}
 		payload := &slack.Payload{
-			Username: "deploy-bot",
-			Text:     fmt.Sprintf("cluster: %s, serviceName: %s\n%s", l.Cluster, l.ServiceName, message),
+			Username: l.SlackUsername,
+			Channel:  l.SlackChannel,
+			Text:     l.slackText(message),
 		}
 		client.Post(payload)
-	case "good":
-	case "danger":
-		client := &slack.Client{WebhookURL: l.SlackWebhookUrl}
+	case "good", "danger":
+		client := &slack.Client{WebhookURL: webhookUrl}
 		attachment := &slack.Attachment{
 			Color: messageType,
-			Text:  fmt.Sprintf("cluster: %s, serviceName: %s\n%s", l.Cluster, l.ServiceName, message),
+			Text:  l.slackText(message),
 		}
 		payload := &slack.Payload{
-			Username:    "deploy-bot",
+			Username:    l.SlackUsername,
+			Channel:     l.SlackChannel,
 			Attachments: []*slack.Attachment{attachment},
 		}
 		client.Post(payload)
 	}
 }
+
+func (l *Logger) slackText(message string) string {
+	text := fmt.Sprintf("cluster: %s, serviceName: %s\n%s", l.Cluster, l.ServiceName, message)
+	if l.DeployID != "" {
+		text = fmt.Sprintf("cluster: %s, serviceName: %s, deployID: %s\n%s", l.Cluster, l.ServiceName, l.DeployID, message)
+	}
+	if l.ConsoleURL != "" {
+		text = strings.TrimRight(text, "\n") + fmt.Sprintf("\nconsole: <%s|open in the ECS console>\n", l.ConsoleURL)
+	}
+	return text
+}
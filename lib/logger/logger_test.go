@@ -0,0 +1,124 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// slackPayload is the part of a payload of the incoming webhook checked by tests
+type slackPayload struct {
+	Text        string `json:"text"`
+	Attachments []struct {
+		Color string `json:"color"`
+		Text  string `json:"text"`
+	} `json:"attachments"`
+}
+
+// newSlackServer returns a webhook server which records posted payloads
+func newSlackServer(t *testing.T) (*httptest.Server, *[]*slackPayload) {
+	var payloads []*slackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the payload is posted as JSON or as a form value of payload
+		body := r.FormValue("payload")
+		if body == "" {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("failed to read the payload: %s", err)
+			}
+			body = string(b)
+		}
+
+		var p slackPayload
+		err := json.Unmarshal([]byte(body), &p)
+		if err != nil {
+			t.Errorf("failed to decode the payload: %s", err)
+		}
+		payloads = append(payloads, &p)
+	}))
+	return server, &payloads
+}
+
+func TestSlackNotifyOn(t *testing.T) {
+	tests := []struct {
+		notifyOn string
+		// want is the message types posted in order
+		want []string
+	}{
+		{notifyOn: "start,success,failure", want: []string{"normal", "good", "danger"}},
+		{notifyOn: "success", want: []string{"good"}},
+		{notifyOn: "start,failure", want: []string{"normal", "danger"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.notifyOn, func(t *testing.T) {
+			server, payloads := newSlackServer(t)
+			defer server.Close()
+
+			notifyOn, err := ParseNotifyOn(tt.notifyOn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewLogger("foo", "bar", []string{server.URL}, ioutil.Discard, ioutil.Discard)
+			l.NotifyOn = notifyOn
+
+			l.Slack("normal", "deploy started\n")
+			l.Slack("good", "successfully deployed\n")
+			l.Slack("danger", "failed to deploy\n")
+
+			var got []string
+			for _, p := range *payloads {
+				if len(p.Attachments) == 0 {
+					got = append(got, "normal")
+					continue
+				}
+				got = append(got, p.Attachments[0].Color)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("posted %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("posted %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSlackConsoleURL(t *testing.T) {
+	server, payloads := newSlackServer(t)
+	defer server.Close()
+
+	l := NewLogger("foo", "bar", []string{server.URL}, ioutil.Discard, ioutil.Discard)
+	l.ConsoleURL = "https://console.aws.amazon.com/ecs/home?region=ap-northeast-1#/clusters/foo/services/bar/details"
+	l.Slack("good", "successfully deployed\n")
+
+	if len(*payloads) != 1 || len((*payloads)[0].Attachments) != 1 {
+		t.Fatalf("success message is not posted: %v", *payloads)
+	}
+	want := "cluster: foo, serviceName: bar\nsuccessfully deployed\nconsole: <" + l.ConsoleURL + "|open in the ECS console>\n"
+	if got := (*payloads)[0].Attachments[0].Text; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
+
+func TestLogPercent(t *testing.T) {
+	var out, errOut bytes.Buffer
+	l := NewLogger("foo", "bar", nil, &out, &errOut)
+	l.Prefix = "[foo] "
+
+	// messages of ECS events and stopped reasons may contain %
+	l.Log("cpu utilization is 100%d\n")
+	l.Result("50% done\n")
+
+	if got := errOut.String(); got != "[foo] cpu utilization is 100%d\n" {
+		t.Errorf("log = %q", got)
+	}
+	if got := out.String(); got != "[foo] 50% done\n" {
+		t.Errorf("result = %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const jobName = "shipctl"
+
+// Deploy is the outcome of a deploy or a rollback
+type Deploy struct {
+	// Command is deploy or rollback. it groups the metrics, so a rollback does not replace those of a deploy
+	Command     string
+	Cluster     string
+	ServiceName string
+	// Revision is the revision deployed. it is omitted if it is 0
+	Revision int64
+	// Status is success or failure
+	Status   string
+	Duration time.Duration
+}
+
+// Push pushes deploy_duration_seconds and deploy_result to the Pushgateway at url.
+// the metrics are grouped by the command, the cluster and the service, so a push replaces the previous one of the service
+func Push(url string, d *Deploy) error {
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "deploy_duration_seconds",
+		Help: "duration of the last deploy in seconds",
+	})
+	duration.Set(d.Duration.Seconds())
+
+	result := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "deploy_result",
+		Help: "result of the last deploy. the value is always 1",
+	}, []string{"status", "revision"})
+	revision := ""
+	if d.Revision > 0 {
+		revision = strconv.FormatInt(d.Revision, 10)
+	}
+	result.WithLabelValues(d.Status, revision).Set(1)
+
+	return push.New(url, jobName).
+		Collector(duration).
+		Collector(result).
+		Grouping("command", d.Command).
+		Grouping("cluster", d.Cluster).
+		Grouping("service", d.ServiceName).
+		Push()
+}
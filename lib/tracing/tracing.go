@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/SKAhack/shipctl"
+
+// EndpointEnv enables tracing when it is set. the exporter also reads the other OTEL_EXPORTER_OTLP_* variables
+const EndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+// Setup exports spans by OTLP over HTTP if EndpointEnv is set, and returns a function to flush them.
+// spans are not recorded otherwise, since the global tracer provider is a no-op by default
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	if os.Getenv(EndpointEnv) == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Start starts a span as a child of the span of ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err in the span if it is not nil, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Service returns attributes of the cluster and the service
+func Service(cluster, serviceName string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("ecs.cluster", cluster),
+		attribute.String("ecs.service", serviceName),
+	}
+}
+
+// Revision returns an attribute of the revision of the task definition
+func Revision(revision int64) attribute.KeyValue {
+	return attribute.Int64("ecs.task_definition.revision", revision)
+}
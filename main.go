@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
 	"github.com/SKAhack/shipctl/cmd"
+	"github.com/SKAhack/shipctl/lib/tracing"
 	"github.com/spf13/cobra"
 )
 
@@ -21,17 +23,47 @@ const (
 var rootCmd = &cobra.Command{
 	Use:   cliName,
 	Short: cliDescription,
+	PersistentPreRunE: func(c *cobra.Command, args []string) error {
+		// flags > environment variables > config file
+		err := cmd.LoadEnv(c)
+		if err != nil {
+			return err
+		}
+		return cmd.LoadConfigFile(c)
+	},
 }
 
 func main() {
 	rootCmd.AddCommand(
 		cmd.NewDeployCommand(os.Stdout, os.Stderr),
+		cmd.NewDeployStatusCommand(os.Stdout, os.Stderr),
+		cmd.NewDiffCommand(os.Stdout, os.Stderr),
 		cmd.NewRollbackCommand(os.Stdout, os.Stderr),
+		cmd.NewCancelCommand(os.Stdout, os.Stderr),
+		cmd.NewListRevisionsCommand(os.Stdout, os.Stderr),
+		cmd.NewHistoryCommand(os.Stdout, os.Stderr),
 		cmd.NewOneshotCommand(os.Stdout, os.Stderr),
+		cmd.NewPreflightCommand(os.Stdout, os.Stderr),
 	)
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	shutdown, err := tracing.Setup(context.Background(), cliName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(cmd.ExitCodeError)
+	}
+
+	// see cmd.ExitCodeOf for the exit codes
+	err = rootCmd.Execute()
+
+	// flush spans before os.Exit, which skips deferred functions
+	if serr := shutdown(context.Background()); serr != nil {
+		fmt.Fprintf(os.Stderr, "failed to export traces: %s\n", serr)
+	}
+
+	if err != nil {
+		if _, ok := err.(*cmd.ExitError); !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(cmd.ExitCodeOf(err))
 	}
 }